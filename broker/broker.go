@@ -0,0 +1,85 @@
+// Package broker defines how the replicas of the signalling server share the
+// connections registered with them and relay messages to one another, so
+// that users and services connected to different replicas can meet.
+package broker
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	proto "github.com/grexie/vault/protocol"
+)
+
+// Presence describes a connection registered with a replica: the hub ID and
+// the replica it is connected to, and what the routing of users to services
+// needs to know about it. A Suspended presence is that of a connection that
+// closed and may still be resumed, which keeps its peers but is not
+// announced to.
+type Presence struct {
+	ID        string            `json:"id"`
+	Replica   string            `json:"replica"`
+	Type      proto.ConnectType `json:"type"`
+	Name      string            `json:"name"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Services  []string          `json:"services,omitempty"`
+	Codecs    []string          `json:"codecs,omitempty"`
+	Suspended bool              `json:"suspended,omitempty"`
+}
+
+// Broker shares presence between replicas and carries messages between them.
+// Presences joined by a replica are listed by every replica until the
+// replica leaves them or stops running. Messages published to a replica are
+// delivered in order to its subscription.
+type Broker interface {
+	CreateFlags(flagSet *flag.FlagSet) error
+	Initialize() error
+	Join(presence Presence) error
+	Leave(presence Presence) error
+	Presences(connectType proto.ConnectType) ([]Presence, error)
+	Publish(replica string, message []byte) error
+	Subscribe(replica string, handler func(message []byte)) error
+}
+
+var brokers = map[string]func() Broker{}
+var brokersMutex = sync.Mutex{}
+
+// Register makes a broker available to Open under name. It is intended to be
+// called from the init function of the broker's package.
+func Register(name string, factory func() Broker) {
+	brokersMutex.Lock()
+	defer brokersMutex.Unlock()
+
+	if _, exists := brokers[name]; exists {
+		panic(fmt.Sprintf("broker %q registered twice", name))
+	}
+	brokers[name] = factory
+}
+
+// Brokers returns the sorted names of the registered brokers.
+func Brokers() []string {
+	brokersMutex.Lock()
+	defer brokersMutex.Unlock()
+
+	names := []string{}
+	for name := range brokers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open returns a new instance of the broker registered as name.
+func Open(name string) (Broker, error) {
+	brokersMutex.Lock()
+	factory, ok := brokers[name]
+	brokersMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown broker %q, available brokers: %v", name, strings.Join(Brokers(), ", "))
+	}
+	return factory(), nil
+}
@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+
+	"github.com/grexie/vault/broker"
+	proto "github.com/grexie/vault/protocol"
+)
+
+// MemoryBroker keeps presence in process memory. It serves a single replica,
+// which never has to relay messages to another one.
+type MemoryBroker struct {
+	sync.Mutex
+	presences   map[string]broker.Presence
+	subscribers map[string]func(message []byte)
+}
+
+func init() {
+	broker.Register("memory", func() broker.Broker {
+		return &MemoryBroker{}
+	})
+}
+
+func (b *MemoryBroker) CreateFlags(flagSet *flag.FlagSet) error {
+	return nil
+}
+
+func (b *MemoryBroker) Initialize() error {
+	b.presences = map[string]broker.Presence{}
+	b.subscribers = map[string]func(message []byte){}
+	return nil
+}
+
+func (b *MemoryBroker) Join(presence broker.Presence) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.presences[presence.ID] = presence
+	return nil
+}
+
+func (b *MemoryBroker) Leave(presence broker.Presence) error {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.presences, presence.ID)
+	return nil
+}
+
+func (b *MemoryBroker) Presences(connectType proto.ConnectType) ([]broker.Presence, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	presences := []broker.Presence{}
+	for _, presence := range b.presences {
+		if presence.Type == connectType {
+			presences = append(presences, presence)
+		}
+	}
+	return presences, nil
+}
+
+func (b *MemoryBroker) Publish(replica string, message []byte) error {
+	b.Lock()
+	handler, ok := b.subscribers[replica]
+	b.Unlock()
+
+	if !ok {
+		return fmt.Errorf("replica %v not found", replica)
+	}
+	handler(message)
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(replica string, handler func(message []byte)) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.subscribers[replica] = handler
+	return nil
+}
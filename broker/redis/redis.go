@@ -0,0 +1,222 @@
+package redis
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/grexie/vault/broker"
+	proto "github.com/grexie/vault/protocol"
+)
+
+// RedisBroker shares presence between replicas through a Redis server. Each
+// presence is a key that expires unless the replica holding the connection
+// refreshes it, so the connections of a replica that stops running disappear
+// after -redis-presence-ttl. Messages are relayed with PUBLISH on a channel
+// per replica.
+type RedisBroker struct {
+	sync.Mutex
+	url       *string
+	prefix    *string
+	ttl       *time.Duration
+	pool      *redis.Pool
+	presences map[string]broker.Presence
+}
+
+func init() {
+	broker.Register("redis", func() broker.Broker {
+		return &RedisBroker{}
+	})
+}
+
+func (b *RedisBroker) CreateFlags(flagSet *flag.FlagSet) error {
+	b.url = flagSet.String("redis-url", "redis://localhost:6379", "url of the redis server shared by the replicas")
+	b.prefix = flagSet.String("redis-prefix", "vault", "prefix of the redis keys and channels of the broker")
+	b.ttl = flagSet.Duration("redis-presence-ttl", 30*time.Second, "time after which the connections of a replica that stopped running are forgotten")
+	return nil
+}
+
+func (b *RedisBroker) Initialize() error {
+	b.presences = map[string]broker.Presence{}
+	b.pool = &redis.Pool{
+		MaxIdle:     4,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(*b.url)
+		},
+	}
+
+	conn := b.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return err
+	}
+
+	go b.refresh()
+	return nil
+}
+
+func (b *RedisBroker) presenceKey(presence broker.Presence) string {
+	return *b.prefix + ":presence:" + string(presence.Type) + ":" + presence.ID
+}
+
+func (b *RedisBroker) channel(replica string) string {
+	return *b.prefix + ":replica:" + replica
+}
+
+func (b *RedisBroker) set(conn redis.Conn, presence broker.Presence) error {
+	if bytes, err := json.Marshal(presence); err != nil {
+		return err
+	} else {
+		_, err := conn.Do("SET", b.presenceKey(presence), bytes, "PX", b.ttl.Milliseconds())
+		return err
+	}
+}
+
+// refresh extends the expiry of the presences joined by this replica.
+func (b *RedisBroker) refresh() {
+	for range time.Tick(*b.ttl / 3) {
+		b.Lock()
+		presences := []broker.Presence{}
+		for _, presence := range b.presences {
+			presences = append(presences, presence)
+		}
+		b.Unlock()
+
+		conn := b.pool.Get()
+		for _, presence := range presences {
+			if err := b.set(conn, presence); err != nil {
+				log.Println("redis broker:", err)
+				break
+			}
+		}
+		conn.Close()
+	}
+}
+
+func (b *RedisBroker) Join(presence broker.Presence) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	if err := b.set(conn, presence); err != nil {
+		return err
+	}
+
+	b.Lock()
+	b.presences[presence.ID] = presence
+	b.Unlock()
+	return nil
+}
+
+func (b *RedisBroker) Leave(presence broker.Presence) error {
+	b.Lock()
+	delete(b.presences, presence.ID)
+	b.Unlock()
+
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", b.presenceKey(presence))
+	return err
+}
+
+func (b *RedisBroker) Presences(connectType proto.ConnectType) ([]broker.Presence, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	pattern := *b.prefix + ":presence:" + string(connectType) + ":*"
+	keys := []interface{}{}
+	cursor := 0
+	for {
+		if values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100)); err != nil {
+			return nil, err
+		} else if next, err := redis.Int(values[0], nil); err != nil {
+			return nil, err
+		} else if page, err := redis.Strings(values[1], nil); err != nil {
+			return nil, err
+		} else {
+			for _, key := range page {
+				keys = append(keys, key)
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+	}
+
+	presences := []broker.Presence{}
+	if len(keys) == 0 {
+		return presences, nil
+	}
+
+	values, err := redis.ByteSlices(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		// keys expiring between SCAN and MGET have no value
+		if value == nil {
+			continue
+		}
+
+		presence := broker.Presence{}
+		if err := json.Unmarshal(value, &presence); err != nil {
+			return nil, err
+		}
+		presences = append(presences, presence)
+	}
+	return presences, nil
+}
+
+func (b *RedisBroker) Publish(replica string, message []byte) error {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", b.channel(replica), message)
+	return err
+}
+
+// Subscribe receives the messages of replica on a connection of its own,
+// subscribing again whenever the connection fails.
+func (b *RedisBroker) Subscribe(replica string, handler func(message []byte)) error {
+	subscribe := func() (*redis.PubSubConn, error) {
+		if conn, err := redis.DialURL(*b.url); err != nil {
+			return nil, err
+		} else {
+			pubSubConn := &redis.PubSubConn{Conn: conn}
+			if err := pubSubConn.Subscribe(b.channel(replica)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return pubSubConn, nil
+		}
+	}
+
+	pubSubConn, err := subscribe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			switch v := pubSubConn.Receive().(type) {
+			case redis.Message:
+				handler(v.Data)
+			case error:
+				log.Println("redis broker:", v)
+				pubSubConn.Close()
+				for {
+					time.Sleep(time.Second)
+					if pubSubConn, err = subscribe(); err == nil {
+						break
+					}
+					log.Println("redis broker:", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
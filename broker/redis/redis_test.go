@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/grexie/vault/broker"
+	proto "github.com/grexie/vault/protocol"
+)
+
+// newTestBroker returns a broker connected to a miniredis server standing in
+// for Redis. Presences are refreshed rarely, so that the test controls when
+// they expire.
+func newTestBroker(t *testing.T) (*RedisBroker, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	b := &RedisBroker{}
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := b.CreateFlags(flagSet); err != nil {
+		t.Fatal(err)
+	} else if err := flagSet.Parse([]string{"-redis-url", "redis://" + server.Addr(), "-redis-presence-ttl", "1h"}); err != nil {
+		t.Fatal(err)
+	} else if err := b.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return b, server
+}
+
+func presenceIDs(t *testing.T, b *RedisBroker, connectType proto.ConnectType) map[string]bool {
+	t.Helper()
+
+	presences, err := b.Presences(connectType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{}
+	for _, presence := range presences {
+		ids[presence.ID] = true
+	}
+	return ids
+}
+
+func TestPresences(t *testing.T) {
+	b, server := newTestBroker(t)
+
+	service := broker.Presence{ID: "service", Replica: "a", Type: proto.CONNECT_TYPE_SERVICE, Labels: map[string]string{"env": "prod"}}
+	user := broker.Presence{ID: "user", Replica: "a", Type: proto.CONNECT_TYPE_USER}
+	for _, presence := range []broker.Presence{service, user} {
+		if err := b.Join(presence); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ids := presenceIDs(t, b, proto.CONNECT_TYPE_SERVICE); len(ids) != 1 || !ids["service"] {
+		t.Errorf("got services %v", ids)
+	}
+	if presences, err := b.Presences(proto.CONNECT_TYPE_SERVICE); err != nil {
+		t.Fatal(err)
+	} else if presences[0].Labels["env"] != "prod" {
+		t.Errorf("got labels %v", presences[0].Labels)
+	}
+
+	if err := b.Leave(user); err != nil {
+		t.Fatal(err)
+	} else if ids := presenceIDs(t, b, proto.CONNECT_TYPE_USER); len(ids) != 0 {
+		t.Errorf("got users %v after leaving", ids)
+	}
+
+	// presences expire unless the replica holding them refreshes them
+	server.FastForward(2 * time.Hour)
+	if ids := presenceIDs(t, b, proto.CONNECT_TYPE_SERVICE); len(ids) != 0 {
+		t.Errorf("got services %v after they expired", ids)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b, _ := newTestBroker(t)
+
+	received := make(chan string, 2)
+	if err := b.Subscribe("a", func(message []byte) {
+		received <- string(message)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range []string{"first", "second"} {
+		if err := b.Publish("a", []byte(message)); err != nil {
+			t.Fatal(err)
+		} else if err := b.Publish("b", []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"first", "second"} {
+		select {
+		case message := <-received:
+			if message != want {
+				t.Errorf("received %q, want %q", message, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("did not receive %q", want)
+		}
+	}
+}
@@ -1,68 +1,158 @@
 package client
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/grexie/vault/hub"
+	sealPlugin "github.com/grexie/vault/seal"
+	storagePlugin "github.com/grexie/vault/storage"
 )
 
 var server *string
+var driverName *string
+var sealName *string
+var codecName *string
+var token *string
+var privateKeyPath *string
+var labels *string
+var rootUsers *string
+var backoffMin *time.Duration
+var backoffMax *time.Duration
+var pingInterval *time.Duration
+var pongTimeout *time.Duration
+var healthAddr *string
+var statusFile *string
+var caCert *string
+var tlsCert *string
+var tlsKey *string
+var masterKeyPath *string
+
+// loadStorageDriver loads the underlying storage driver and the auto seal, if
+// any. The vault starts sealed, so storage refuses every operation until it
+// is unsealed.
+func loadStorageDriver() error {
+	name, seal := *driverName, *sealName
+	flagSet := newFlagSet(flag.ExitOnError)
+
+	var s sealPlugin.Seal
+	if seal != shamirSeal {
+		var err error
+		if s, err = sealPlugin.Open(seal); err != nil {
+			return err
+		} else if err := s.CreateFlags(flagSet); err != nil {
+			return err
+		}
+	}
+
+	if driver, err := storagePlugin.Load(name, flagSet, os.Args[2:]); err != nil {
+		return err
+	} else {
+		rawStorage = driver
+		setStorage(&sealedDriver{})
+	}
+
+	if s != nil {
+		if err := s.Initialize(); err != nil {
+			return err
+		}
+		autoSeal = s
+	}
+	return nil
+}
+
+func newFlagSet(errorHandling flag.ErrorHandling) *flag.FlagSet {
+	flagSet := flag.NewFlagSet("client", errorHandling)
+	server = flagSet.String("server", "ws://localhost:8080", "server url, wss:// to connect with TLS")
+	caCert = flagSet.String("ca-cert", "", "PEM file of the CAs to verify the server certificate against instead of the system roots")
+	tlsCert = flagSet.String("tls-cert", "", "PEM file of the client certificate presented to servers requiring one")
+	tlsKey = flagSet.String("tls-key", "", "PEM file of the private key of -tls-cert")
+	driverName = flagSet.String("driver", "bolt", "storage driver: bolt, memory, or the name or path of a storage driver plugin such as mdbx for mdbx.so")
+	codecName = flagSet.String("codec", hub.CBOR.Name(), "codec to offer the server, falling back to json: "+strings.Join(hub.Codecs(), ", "))
+	masterKeyPath = flagSet.String("master-key", "", "master key file of a vault created before it was sealed, adopted as the master key by init so that its data stays readable")
+	sealName = flagSet.String("seal", shamirSeal, "seal protecting the master key: shamir to unseal with key shares, or the name of an auto seal such as file or pkcs11")
+	token = flagSet.String("token", "", "bearer token to authenticate with")
+	privateKeyPath = flagSet.String("key", "", "file containing the ed25519 private key to authenticate with")
+	labels = flagSet.String("labels", "", "comma separated key=value labels users can select this service by, as far as the server allows them for its identity")
+	rootUsers = flagSet.String("root-users", "", "comma separated user identities granted every capability regardless of policy")
+	backoffMin = flagSet.Duration("backoff-min", time.Second, "delay before reconnecting after the first failed attempt, doubled after every further one")
+	backoffMax = flagSet.Duration("backoff-max", time.Minute, "maximum delay between connection attempts")
+	pingInterval = flagSet.Duration("ping-interval", 15*time.Second, "interval between keepalive pings to the server, 0 to disable")
+	pongTimeout = flagSet.Duration("pong-timeout", 10*time.Second, "time after a missed pong at which the connection is considered dead")
+	healthAddr = flagSet.String("health-addr", "", "address to serve the health of the client on at /health, disabled if empty")
+	statusFile = flagSet.String("status-file", "", "file the health of the client is written to whenever it changes, disabled if empty")
+
+	return flagSet
+}
 
 func NewFlagSet() *flag.FlagSet {
-	flagSet := flag.NewFlagSet("client", flag.ExitOnError)
-	server = flagSet.String("server", "ws://localhost:8080", "server url")
+	flagSet := newFlagSet(flag.ContinueOnError)
+	buf := bytes.NewBuffer([]byte{})
+	flagSet.SetOutput(buf)
 	return flagSet
 }
 
+// connect keeps a connection to the server, reconnecting after it fails. The
+// server protocol is kept across connections so that reconnecting resumes
+// the session.
 func connect(interrupt chan os.Signal) {
+	protocol := newServerProtocol()
+
 	for {
 		log.Println("reconnecting")
+		connectionConnecting()
 		reconnect := make(chan error, 1)
-		var protocol *serverProtocol
 		var err error
 		var c *websocket.Conn
 
-		if c, _, err = websocket.DefaultDialer.Dial(*server, nil); err != nil {
+		dialer := *websocket.DefaultDialer
+		dialer.Subprotocols = hub.Subprotocols([]string{*codecName, hub.JSON.Name()})
+
+		if dialer.TLSClientConfig, err = loadTLSConfig(); err != nil {
+			reconnect <- err
+		} else if c, _, err = dialer.Dial(*server, nil); err != nil {
 			reconnect <- err
 		} else {
-			h := hub.NewHub(c)
-
-			if protocol, err = newServerProtocol(h); err != nil {
-				reconnect <- err
-			} else {
-				defer func() {
-					if protocol != nil {
-						protocol.Done()
-					}
-				}()
-				go protocol.Start()
-
-				go func() {
-					defer close(reconnect)
-					for {
-						if _, message, err := c.ReadMessage(); err != nil {
-							reconnect <- err
-							return
-						} else if err := h.ProcessMessage(message); err != nil {
-							reconnect <- err
-							return
-						}
-					}
-				}()
+			h := hub.NewHubWithCodec(c, hub.SubprotocolCodec(c.Subprotocol()))
+			protocol.attach(c, h)
+			go protocol.Start()
 
-			}
+			closed := make(chan struct{})
+			keepalive(c, closed)
+
+			go func() {
+				defer close(reconnect)
+				defer close(closed)
+				defer c.Close()
+				for {
+					if _, message, err := c.ReadMessage(); err != nil {
+						h.Close(err)
+						reconnect <- err
+						return
+					} else if err := h.ProcessMessage(message); err != nil {
+						h.Close(err)
+						reconnect <- err
+						return
+					} else {
+						extendReadDeadline(c)
+					}
+				}
+			}()
 		}
 
 		select {
 		case err := <-reconnect:
-			log.Println(err)
+			delay := connectionFailed(err)
+			log.Println(err, "- reconnecting in", delay.Round(time.Millisecond))
 			select {
-			case <-time.After(time.Second):
+			case <-time.After(delay):
 			case <-interrupt:
 				return
 			}
@@ -92,7 +182,60 @@ func connect(interrupt chan os.Signal) {
 	}
 }
 
+// extendReadDeadline gives the server until the next ping has been answered
+// to send something, after which the connection is considered dead.
+func extendReadDeadline(c *websocket.Conn) {
+	if *pingInterval > 0 {
+		c.SetReadDeadline(time.Now().Add(*pingInterval + *pongTimeout))
+	}
+}
+
+// keepalive pings the server every -ping-interval until closed is closed.
+// Pongs and other messages extend the read deadline of c, so a connection
+// that stops answering fails its read and is reconnected.
+func keepalive(c *websocket.Conn, closed chan struct{}) {
+	if *pingInterval <= 0 {
+		return
+	}
+
+	extendReadDeadline(c)
+	c.SetPongHandler(func(string) error {
+		extendReadDeadline(c)
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(*pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(*pongTimeout)); err != nil {
+					log.Println("ping:", err)
+				}
+			case <-closed:
+				return
+			}
+		}
+	}()
+}
+
 func Run() error {
+	if _, err := hub.LookupCodec(*codecName); err != nil {
+		return err
+	} else if *backoffMin <= 0 || *backoffMax < *backoffMin {
+		return fmt.Errorf("-backoff-min must be positive and no more than -backoff-max")
+	} else if _, err := loadTLSConfig(); err != nil {
+		return err
+	} else if err := loadStorageDriver(); err != nil {
+		return err
+	} else if err := autoUnseal(); err != nil {
+		return err
+	} else if err := startHealthReporting(); err != nil {
+		return err
+	}
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 	connect(interrupt)
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+// loadPrivateKey reads an ed25519 private key from filename, either as a
+// PKCS#8 PEM block or as a base64 encoded seed or private key.
+func loadPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(bytes); block != nil {
+		if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		} else if privateKey, ok := key.(ed25519.PrivateKey); !ok {
+			return nil, errors.New("private key is not an ed25519 key")
+		} else {
+			return privateKey, nil
+		}
+	}
+
+	if key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(bytes))); err != nil {
+		return nil, err
+	} else if len(key) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(key), nil
+	} else if len(key) == ed25519.PrivateKeySize {
+		return ed25519.PrivateKey(key), nil
+	} else {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+}
+
+// credential returns the credential the service authenticates with, signing
+// a challenge issued by the server when a private key is configured. Without
+// a token or private key, a service presenting a client certificate
+// authenticates with it.
+func (p *serverProtocol) credential() (*proto.Credential, error) {
+	if *token != "" {
+		return &proto.Credential{
+			Type:  proto.CREDENTIAL_TYPE_TOKEN,
+			Token: *token,
+		}, nil
+	} else if *privateKeyPath == "" && *tlsCert != "" {
+		return &proto.Credential{
+			Type: proto.CREDENTIAL_TYPE_CERTIFICATE,
+		}, nil
+	} else if *privateKeyPath == "" {
+		return nil, nil
+	}
+
+	if privateKey, err := loadPrivateKey(*privateKeyPath); err != nil {
+		return nil, err
+	} else if challengeResponse, err := hub.Call[proto.ChallengeResponse](p.signalling(), "challenge", nil); err != nil {
+		return nil, err
+	} else if challenge, err := base64.StdEncoding.DecodeString(challengeResponse.Challenge); err != nil {
+		return nil, err
+	} else {
+		signature := ed25519.Sign(privateKey, proto.ChallengeMessage(challenge, proto.CONNECT_TYPE_SERVICE))
+
+		return &proto.Credential{
+			Type:      proto.CREDENTIAL_TYPE_ED25519,
+			PublicKey: base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)),
+			Signature: base64.StdEncoding.EncodeToString(signature),
+		}, nil
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type connectionState string
+
+const (
+	CONNECTION_STATE_CONNECTING   connectionState = "connecting"
+	CONNECTION_STATE_CONNECTED    connectionState = "connected"
+	CONNECTION_STATE_RECONNECTING connectionState = "reconnecting"
+)
+
+// healthStatus is served on -health-addr and written to -status-file.
+// Attempts counts the connection attempts that failed since the client was
+// last connected.
+type healthStatus struct {
+	State       connectionState `json:"state"`
+	Since       time.Time       `json:"since"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"lastError,omitempty"`
+	NextAttempt *time.Time      `json:"nextAttempt,omitempty"`
+	Seal        string          `json:"seal"`
+	Initialized bool            `json:"initialized"`
+	Sealed      bool            `json:"sealed"`
+}
+
+// healthy reports whether the client is connected with an unsealed vault.
+func (s *healthStatus) healthy() bool {
+	return s.State == CONNECTION_STATE_CONNECTED && !s.Sealed
+}
+
+var health = healthStatus{State: CONNECTION_STATE_CONNECTING, Since: time.Now()}
+var healthMutex = sync.Mutex{}
+var statusFileMutex = sync.Mutex{}
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// backoffDelay returns the delay before the next connection attempt after
+// attempts failed ones: -backoff-min doubled for every failed attempt up to
+// -backoff-max, of which a random half is taken off so that clients cut off
+// together do not reconnect together.
+func backoffDelay(attempts int) time.Duration {
+	delay := *backoffMin
+	for i := 1; i < attempts && delay < *backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > *backoffMax {
+		delay = *backoffMax
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(random.Int63n(int64(delay/2)+1))
+}
+
+func setConnectionState(state connectionState, update func(*healthStatus)) {
+	healthMutex.Lock()
+	if health.State != state {
+		health.State = state
+		health.Since = time.Now()
+	}
+	update(&health)
+	healthMutex.Unlock()
+
+	go writeStatusFile()
+}
+
+func connectionConnecting() {
+	setConnectionState(CONNECTION_STATE_CONNECTING, func(s *healthStatus) {
+		s.NextAttempt = nil
+	})
+}
+
+func connectionEstablished() {
+	setConnectionState(CONNECTION_STATE_CONNECTED, func(s *healthStatus) {
+		s.Attempts = 0
+		s.LastError = ""
+	})
+}
+
+// connectionFailed records that the connection failed with err and returns
+// how long to wait before connecting again.
+func connectionFailed(err error) time.Duration {
+	healthMutex.Lock()
+	attempts := health.Attempts + 1
+	healthMutex.Unlock()
+
+	delay := backoffDelay(attempts)
+	nextAttempt := time.Now().Add(delay)
+	setConnectionState(CONNECTION_STATE_RECONNECTING, func(s *healthStatus) {
+		s.Attempts = attempts
+		s.LastError = err.Error()
+		s.NextAttempt = &nextAttempt
+	})
+	return delay
+}
+
+// currentHealth returns the connection state along with the seal status.
+func currentHealth() healthStatus {
+	healthMutex.Lock()
+	status := health
+	healthMutex.Unlock()
+
+	status.Seal = *sealName
+	status.Sealed = true
+	if sealStatus, err := sealStatus(); err == nil {
+		status.Initialized = sealStatus.Initialized
+		status.Sealed = sealStatus.Sealed
+	}
+	return status
+}
+
+// writeStatusFile replaces the status file, if any, with the current health.
+func writeStatusFile() {
+	if *statusFile == "" {
+		return
+	}
+
+	statusFileMutex.Lock()
+	defer statusFileMutex.Unlock()
+
+	status := currentHealth()
+	if bytes, err := json.MarshalIndent(&status, "", "  "); err != nil {
+		log.Println("status file:", err)
+	} else if file, err := os.CreateTemp(filepath.Dir(*statusFile), ".status-*"); err != nil {
+		log.Println("status file:", err)
+	} else if _, err := file.Write(append(bytes, '\n')); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		log.Println("status file:", err)
+	} else if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		log.Println("status file:", err)
+	} else if err := os.Rename(file.Name(), *statusFile); err != nil {
+		os.Remove(file.Name())
+		log.Println("status file:", err)
+	}
+}
+
+// healthHandler serves the health of the client, with status 200 when it is
+// healthy and 503 otherwise.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := currentHealth()
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.healthy() {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&status)
+}
+
+// startHealthReporting serves the health endpoint on -health-addr and
+// writes the status file, if either is configured.
+func startHealthReporting() error {
+	writeStatusFile()
+
+	if *healthAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", *healthAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Println("health:", err)
+		}
+	}()
+	return nil
+}
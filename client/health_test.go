@@ -0,0 +1,65 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	useDefaultFlags()
+	defer func(min, max time.Duration) { *backoffMin, *backoffMax = min, max }(*backoffMin, *backoffMax)
+	*backoffMin, *backoffMax = time.Second, 10*time.Second
+
+	tests := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := backoffDelay(test.attempts); delay < test.max/2 || delay > test.max {
+				t.Fatalf("backoffDelay(%v) = %v, want between %v and %v", test.attempts, delay, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+// connectionHealth returns the connection state, without the seal status.
+func connectionHealth() healthStatus {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	return health
+}
+
+func TestConnectionAttempts(t *testing.T) {
+	useDefaultFlags()
+
+	for i := 1; i <= 3; i++ {
+		connectionFailed(errors.New("refused"))
+		if status := connectionHealth(); status.State != CONNECTION_STATE_RECONNECTING || status.Attempts != i || status.LastError != "refused" {
+			t.Fatalf("after %v failures got %+v", i, status)
+		} else if status.NextAttempt == nil {
+			t.Fatal("no next attempt after a failure")
+		}
+	}
+
+	connectionConnecting()
+	if status := connectionHealth(); status.State != CONNECTION_STATE_CONNECTING || status.Attempts != 3 || status.NextAttempt != nil {
+		t.Fatalf("connecting got %+v", status)
+	}
+
+	connectionEstablished()
+	if status := connectionHealth(); status.State != CONNECTION_STATE_CONNECTED || status.Attempts != 0 || status.LastError != "" {
+		t.Fatalf("connected got %+v", status)
+	}
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+func rotateKey(k *key) error {
+	if version, err := generateKeyVersion(k.Type, k.LatestVersion+1); err != nil {
+		return err
+	} else {
+		k.Versions[version.Version] = version
+		k.LatestVersion = version.Version
+		return nil
+	}
+}
+
+func setKeyConfig(k *key, req *proto.SetKeyConfigRequest) error {
+	minDecryptionVersion := k.MinDecryptionVersion
+	if req.MinDecryptionVersion != nil {
+		minDecryptionVersion = *req.MinDecryptionVersion
+	}
+	minEncryptionVersion := k.MinEncryptionVersion
+	if req.MinEncryptionVersion != nil {
+		minEncryptionVersion = *req.MinEncryptionVersion
+	}
+
+	if minDecryptionVersion < k.MinAvailableVersion || minDecryptionVersion > k.LatestVersion {
+		return hub.Errorf(hub.CodeInvalidArgument, "minimum decryption version must be between %d and %d", k.MinAvailableVersion, k.LatestVersion)
+	} else if minEncryptionVersion != 0 && (minEncryptionVersion < minDecryptionVersion || minEncryptionVersion > k.LatestVersion) {
+		return hub.Errorf(hub.CodeInvalidArgument, "minimum encryption version must be 0 or between %d and %d", minDecryptionVersion, k.LatestVersion)
+	}
+
+	k.MinDecryptionVersion = minDecryptionVersion
+	k.MinEncryptionVersion = minEncryptionVersion
+	if req.DeletionAllowed != nil {
+		k.DeletionAllowed = *req.DeletionAllowed
+	}
+	if req.Exportable != nil {
+		if k.Exportable && !*req.Exportable {
+			return hub.NewError(hub.CodeInvalidArgument, "an exportable key cannot be made non-exportable")
+		}
+		k.Exportable = *req.Exportable
+	}
+
+	return nil
+}
+
+// trimKey permanently removes the versions of k below minAvailableVersion.
+// Versions that may still be used for decryption or encryption cannot be
+// trimmed.
+func trimKey(k *key, minAvailableVersion int) error {
+	if minAvailableVersion < k.MinAvailableVersion {
+		return hub.Errorf(hub.CodeInvalidArgument, "versions below %d have already been trimmed", k.MinAvailableVersion)
+	} else if minAvailableVersion > k.MinDecryptionVersion {
+		return hub.Errorf(hub.CodeInvalidArgument, "minimum available version cannot exceed the minimum decryption version %d", k.MinDecryptionVersion)
+	} else if k.MinEncryptionVersion != 0 && minAvailableVersion > k.MinEncryptionVersion {
+		return hub.Errorf(hub.CodeInvalidArgument, "minimum available version cannot exceed the minimum encryption version %d", k.MinEncryptionVersion)
+	}
+
+	for version := range k.Versions {
+		if version < minAvailableVersion {
+			delete(k.Versions, version)
+		}
+	}
+	k.MinAvailableVersion = minAvailableVersion
+
+	return nil
+}
+
+func deleteKey(nameOrID string) error {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	if k, err := loadKey(nameOrID); err != nil {
+		return err
+	} else if !k.DeletionAllowed {
+		return hub.NewError(hub.CodeFailedPrecondition, "deletion is not allowed for this key")
+	} else if err := storage().Remove(keyNamesDomain, k.Name); err != nil {
+		return err
+	} else {
+		return storage().Remove(keysDomain, k.ID)
+	}
+}
+
+// export encodes the private material of version, as a base64 string for
+// symmetric keys and as a PKCS#8 PEM block otherwise.
+func (k *key) export(version *keyVersion) string {
+	if k.Type == proto.KEY_TYPE_AES256 {
+		return base64.StdEncoding.EncodeToString(version.Secret)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: version.Secret,
+	}))
+}
+
+func (p *userProtocol) onRotateKey(req *hub.Request, rotateKeyRequest proto.RotateKeyRequest) (*proto.RotateKeyResponse, error) {
+	if k, err := updateKey(rotateKeyRequest.Key, rotateKey); err != nil {
+		return nil, err
+	} else {
+		return &proto.RotateKeyResponse{
+			Key: k.public(),
+		}, nil
+	}
+}
+
+func (p *userProtocol) onSetKeyConfig(req *hub.Request, setKeyConfigRequest proto.SetKeyConfigRequest) (*proto.SetKeyConfigResponse, error) {
+	if k, err := updateKey(setKeyConfigRequest.Key, func(k *key) error {
+		return setKeyConfig(k, &setKeyConfigRequest)
+	}); err != nil {
+		return nil, err
+	} else {
+		return &proto.SetKeyConfigResponse{
+			Key: k.public(),
+		}, nil
+	}
+}
+
+func (p *userProtocol) onTrimKey(req *hub.Request, trimKeyRequest proto.TrimKeyRequest) (*proto.TrimKeyResponse, error) {
+	if k, err := updateKey(trimKeyRequest.Key, func(k *key) error {
+		return trimKey(k, trimKeyRequest.MinAvailableVersion)
+	}); err != nil {
+		return nil, err
+	} else {
+		return &proto.TrimKeyResponse{
+			Key: k.public(),
+		}, nil
+	}
+}
+
+func (p *userProtocol) onDeleteKey(req *hub.Request, deleteKeyRequest proto.DeleteKeyRequest) (interface{}, error) {
+	return nil, deleteKey(deleteKeyRequest.Key)
+}
+
+func (p *userProtocol) onExportKey(req *hub.Request, exportKeyRequest proto.ExportKeyRequest) (*proto.ExportKeyResponse, error) {
+	if k, err := loadKey(exportKeyRequest.Key); err != nil {
+		return nil, err
+	} else if !k.Exportable {
+		return nil, hub.NewError(hub.CodeFailedPrecondition, "key is not exportable")
+	} else {
+		keys := map[int]string{}
+
+		if exportKeyRequest.KeyVersion != 0 {
+			if version, err := k.version(exportKeyRequest.KeyVersion); err != nil {
+				return nil, err
+			} else {
+				keys[version.Version] = k.export(version)
+			}
+		} else {
+			for _, version := range k.Versions {
+				keys[version.Version] = k.export(version)
+			}
+		}
+
+		return &proto.ExportKeyResponse{
+			ID:   k.ID,
+			Name: k.Name,
+			Type: k.Type,
+			Keys: keys,
+		}, nil
+	}
+}
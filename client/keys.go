@@ -0,0 +1,241 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+const keysDomain = "keys"
+const keyNamesDomain = "key-names"
+
+var keysMutex = sync.Mutex{}
+
+var errKeyNotFound = hub.NewError(hub.CodeNotFound, "key not found")
+
+type keyVersion struct {
+	Version   int       `json:"version"`
+	Secret    []byte    `json:"secret"`
+	PublicKey []byte    `json:"publicKey,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type key struct {
+	ID                   string              `json:"id"`
+	Name                 string              `json:"name"`
+	Type                 proto.KeyType       `json:"type"`
+	LatestVersion        int                 `json:"latestVersion"`
+	MinAvailableVersion  int                 `json:"minAvailableVersion"`
+	MinDecryptionVersion int                 `json:"minDecryptionVersion"`
+	MinEncryptionVersion int                 `json:"minEncryptionVersion"`
+	DeletionAllowed      bool                `json:"deletionAllowed"`
+	Exportable           bool                `json:"exportable"`
+	Versions             map[int]*keyVersion `json:"versions"`
+	Metadata             map[string]string   `json:"metadata,omitempty"`
+	CreatedAt            time.Time           `json:"createdAt"`
+}
+
+// generateKeyVersion creates new key material of keyType. Symmetric keys keep
+// the raw key as the secret; asymmetric keys keep the PKCS#8 encoded private
+// key as the secret and the PKIX encoded public key alongside it.
+func generateKeyVersion(keyType proto.KeyType, version int) (*keyVersion, error) {
+	var private interface{}
+	var public interface{}
+
+	switch keyType {
+	case proto.KEY_TYPE_AES256:
+		secret := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+			return nil, err
+		}
+		return &keyVersion{
+			Version:   version,
+			Secret:    secret,
+			CreatedAt: time.Now().UTC(),
+		}, nil
+	case proto.KEY_TYPE_ED25519:
+		if pub, priv, err := ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		} else {
+			private, public = priv, pub
+		}
+	case proto.KEY_TYPE_ECDSA_P256:
+		if priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		} else {
+			private, public = priv, &priv.PublicKey
+		}
+	case proto.KEY_TYPE_RSA_2048, proto.KEY_TYPE_RSA_4096:
+		bits := 2048
+		if keyType == proto.KEY_TYPE_RSA_4096 {
+			bits = 4096
+		}
+		if priv, err := rsa.GenerateKey(rand.Reader, bits); err != nil {
+			return nil, err
+		} else {
+			private, public = priv, &priv.PublicKey
+		}
+	default:
+		return nil, hub.Errorf(hub.CodeInvalidArgument, "unsupported key type \"%v\"", keyType)
+	}
+
+	if secret, err := x509.MarshalPKCS8PrivateKey(private); err != nil {
+		return nil, err
+	} else if publicKey, err := x509.MarshalPKIXPublicKey(public); err != nil {
+		return nil, err
+	} else {
+		return &keyVersion{
+			Version:   version,
+			Secret:    secret,
+			PublicKey: publicKey,
+			CreatedAt: time.Now().UTC(),
+		}, nil
+	}
+}
+
+// public returns the description of k that may leave the vault. It never
+// includes private key material.
+func (k *key) public() proto.Key {
+	publicKeys := map[int]string{}
+	for version, v := range k.Versions {
+		if v.PublicKey != nil {
+			publicKeys[version] = string(pem.EncodeToMemory(&pem.Block{
+				Type:  "PUBLIC KEY",
+				Bytes: v.PublicKey,
+			}))
+		}
+	}
+
+	return proto.Key{
+		ID:                   k.ID,
+		Name:                 k.Name,
+		Type:                 k.Type,
+		LatestVersion:        k.LatestVersion,
+		MinAvailableVersion:  k.MinAvailableVersion,
+		MinDecryptionVersion: k.MinDecryptionVersion,
+		MinEncryptionVersion: k.MinEncryptionVersion,
+		DeletionAllowed:      k.DeletionAllowed,
+		Exportable:           k.Exportable,
+		PublicKeys:           publicKeys,
+		Metadata:             k.Metadata,
+		CreatedAt:            k.CreatedAt,
+	}
+}
+
+func (k *key) save() error {
+	if bytes, err := json.Marshal(k); err != nil {
+		return err
+	} else {
+		return storage().Set(keysDomain, k.ID, string(bytes))
+	}
+}
+
+// loadKey returns the key identified by either its ID or its name. IDs are
+// resolved first, so that a key named after the ID of another key cannot
+// stand in for it.
+func loadKey(nameOrID string) (*key, error) {
+	item, err := storage().Get(keysDomain, nameOrID)
+	if err != nil {
+		return nil, err
+	} else if item == nil {
+		if name, err := storage().Get(keyNamesDomain, nameOrID); err != nil {
+			return nil, err
+		} else if name == nil {
+			return nil, errKeyNotFound
+		} else if item, err = storage().Get(keysDomain, name.Value); err != nil {
+			return nil, err
+		} else if item == nil {
+			return nil, errKeyNotFound
+		}
+	}
+
+	var k key
+	if err := json.Unmarshal([]byte(item.Value), &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// updateKey loads the key identified by nameOrID, applies update to it and
+// saves it, serialized with every other change to the keyring.
+func updateKey(nameOrID string, update func(k *key) error) (*key, error) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	if k, err := loadKey(nameOrID); err != nil {
+		return nil, err
+	} else if err := update(k); err != nil {
+		return nil, err
+	} else if err := k.save(); err != nil {
+		return nil, err
+	} else {
+		return k, nil
+	}
+}
+
+func createKey(req *proto.CreateKeyRequest) (*key, error) {
+	if req.Name == "" {
+		return nil, hub.NewError(hub.CodeInvalidArgument, "key name is required")
+	} else if _, err := uuid.Parse(req.Name); err == nil {
+		return nil, hub.NewError(hub.CodeInvalidArgument, "key name cannot be a key ID")
+	}
+
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	if item, err := storage().Get(keyNamesDomain, req.Name); err != nil {
+		return nil, err
+	} else if item != nil {
+		return nil, hub.Errorf(hub.CodeAlreadyExists, "key \"%v\" already exists", req.Name)
+	} else if item, err := storage().Get(keysDomain, req.Name); err != nil {
+		return nil, err
+	} else if item != nil {
+		return nil, hub.NewError(hub.CodeInvalidArgument, "key name cannot be a key ID")
+	} else if version, err := generateKeyVersion(req.Type, 1); err != nil {
+		return nil, err
+	} else {
+		k := &key{
+			ID:                   uuid.NewString(),
+			Name:                 req.Name,
+			Type:                 req.Type,
+			LatestVersion:        1,
+			MinAvailableVersion:  1,
+			MinDecryptionVersion: 1,
+			DeletionAllowed:      req.DeletionAllowed,
+			Exportable:           req.Exportable,
+			Versions:             map[int]*keyVersion{1: version},
+			Metadata:             req.Metadata,
+			CreatedAt:            version.CreatedAt,
+		}
+
+		if err := k.save(); err != nil {
+			return nil, err
+		} else if err := storage().Set(keyNamesDomain, k.Name, k.ID); err != nil {
+			return nil, err
+		} else {
+			return k, nil
+		}
+	}
+}
+
+func (p *userProtocol) onCreateKey(req *hub.Request, createKeyRequest proto.CreateKeyRequest) (*proto.CreateKeyResponse, error) {
+	if k, err := createKey(&createKeyRequest); err != nil {
+		return nil, err
+	} else {
+		return &proto.CreateKeyResponse{
+			Key: k.public(),
+		}, nil
+	}
+}
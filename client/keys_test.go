@@ -0,0 +1,85 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+func TestCreateKeyName(t *testing.T) {
+	useMemoryStorage(t)
+
+	victim, err := createKey(&proto.CreateKeyRequest{Name: "victim", Type: proto.KEY_TYPE_AES256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"", hub.ErrInvalidArgument},
+		{victim.ID, hub.ErrInvalidArgument},
+		{uuid.NewString(), hub.ErrInvalidArgument},
+		{"victim", hub.ErrAlreadyExists},
+		{"other", nil},
+	}
+
+	for _, test := range tests {
+		_, err := createKey(&proto.CreateKeyRequest{Name: test.name, Type: proto.KEY_TYPE_AES256, Exportable: true})
+		if test.want == nil && err != nil {
+			t.Errorf("createKey(%q): %v", test.name, err)
+		} else if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("createKey(%q): got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+// TestLoadKeyShadowing checks that a key named after the ID of another key,
+// as stored before such names were refused, does not stand in for it.
+func TestLoadKeyShadowing(t *testing.T) {
+	useMemoryStorage(t)
+
+	victim, err := createKey(&proto.CreateKeyRequest{Name: "victim", Type: proto.KEY_TYPE_AES256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor, err := createKey(&proto.CreateKeyRequest{Name: "impostor", Type: proto.KEY_TYPE_AES256, Exportable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage().Set(keyNamesDomain, victim.ID, impostor.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		nameOrID string
+		want     string
+	}{
+		{victim.ID, "victim"},
+		{"victim", "victim"},
+		{impostor.ID, "impostor"},
+		{"impostor", "impostor"},
+	}
+
+	for _, test := range tests {
+		if k, err := loadKey(test.nameOrID); err != nil {
+			t.Errorf("loadKey(%q): %v", test.nameOrID, err)
+		} else if k.Name != test.want {
+			t.Errorf("loadKey(%q) = %v, want %v", test.nameOrID, k.Name, test.want)
+		}
+
+		if name, err := keyName(test.nameOrID); err != nil {
+			t.Errorf("keyName(%q): %v", test.nameOrID, err)
+		} else if name != test.want {
+			t.Errorf("keyName(%q) = %v, want %v", test.nameOrID, name, test.want)
+		}
+	}
+
+	if _, err := loadKey("missing"); err != errKeyNotFound {
+		t.Errorf("loadKey(\"missing\"): got %v, want key not found", err)
+	}
+}
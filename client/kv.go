@@ -0,0 +1,312 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+const kvMetadataDomain = "kv-metadata"
+const kvDataDomain = "kv-data"
+const defaultKVMaxVersions = 10
+
+var kvMutex = sync.Mutex{}
+
+var errSecretNotFound = hub.NewError(hub.CodeNotFound, "secret not found")
+
+func kvDataKey(path string, version int) string {
+	return fmt.Sprintf("%v\x00%d", path, version)
+}
+
+// loadKVMetadata returns the metadata of the secret at path, or nil if
+// nothing has been written there.
+func loadKVMetadata(path string) (*proto.KVMetadata, error) {
+	var metadata proto.KVMetadata
+
+	if item, err := storage().Get(kvMetadataDomain, path); err != nil {
+		return nil, err
+	} else if item == nil {
+		return nil, nil
+	} else if err := json.Unmarshal([]byte(item.Value), &metadata); err != nil {
+		return nil, err
+	} else {
+		return &metadata, nil
+	}
+}
+
+func saveKVMetadata(metadata *proto.KVMetadata) error {
+	if bytes, err := json.Marshal(metadata); err != nil {
+		return err
+	} else {
+		return storage().Set(kvMetadataDomain, metadata.Path, string(bytes))
+	}
+}
+
+func newKVMetadata(path string) *proto.KVMetadata {
+	now := time.Now().UTC()
+	return &proto.KVMetadata{
+		Path:      path,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Versions:  map[int]*proto.KVVersionMetadata{},
+	}
+}
+
+func kvMaxVersions(metadata *proto.KVMetadata) int {
+	if metadata.MaxVersions > 0 {
+		return metadata.MaxVersions
+	}
+	return defaultKVMaxVersions
+}
+
+// pruneKVVersions removes the oldest versions of a secret until no more than
+// its maximum number of versions remain.
+func pruneKVVersions(metadata *proto.KVMetadata) error {
+	versions := []int{}
+	for version := range metadata.Versions {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	for len(versions) > kvMaxVersions(metadata) {
+		if err := storage().Remove(kvDataDomain, kvDataKey(metadata.Path, versions[0])); err != nil {
+			return err
+		}
+		delete(metadata.Versions, versions[0])
+		versions = versions[1:]
+	}
+
+	if len(versions) > 0 {
+		metadata.OldestVersion = versions[0]
+	}
+	return nil
+}
+
+func kvPut(req *proto.KVPutRequest) (*proto.KVVersionMetadata, error) {
+	if req.Path == "" {
+		return nil, hub.NewError(hub.CodeInvalidArgument, "path is required")
+	}
+
+	kvMutex.Lock()
+	defer kvMutex.Unlock()
+
+	metadata, err := loadKVMetadata(req.Path)
+	if err != nil {
+		return nil, err
+	} else if metadata == nil {
+		metadata = newKVMetadata(req.Path)
+	}
+
+	if req.Cas == nil && metadata.CasRequired {
+		return nil, hub.NewError(hub.CodeFailedPrecondition, "check-and-set parameter required for this path")
+	} else if req.Cas != nil && *req.Cas != metadata.CurrentVersion {
+		return nil, hub.Errorf(hub.CodeFailedPrecondition, "check-and-set parameter did not match the current version %d", metadata.CurrentVersion)
+	}
+
+	version := &proto.KVVersionMetadata{
+		Version:   metadata.CurrentVersion + 1,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if bytes, err := json.Marshal(req.Data); err != nil {
+		return nil, err
+	} else if err := storage().Set(kvDataDomain, kvDataKey(req.Path, version.Version), string(bytes)); err != nil {
+		return nil, err
+	}
+
+	metadata.Versions[version.Version] = version
+	metadata.CurrentVersion = version.Version
+	metadata.UpdatedAt = version.CreatedAt
+
+	if err := pruneKVVersions(metadata); err != nil {
+		return nil, err
+	} else if err := saveKVMetadata(metadata); err != nil {
+		return nil, err
+	} else {
+		return version, nil
+	}
+}
+
+func kvGet(req *proto.KVGetRequest) (*proto.KVGetResponse, error) {
+	if metadata, err := loadKVMetadata(req.Path); err != nil {
+		return nil, err
+	} else if metadata == nil || metadata.CurrentVersion == 0 {
+		return nil, errSecretNotFound
+	} else {
+		versionNumber := req.Version
+		if versionNumber == 0 {
+			versionNumber = metadata.CurrentVersion
+		}
+
+		version, ok := metadata.Versions[versionNumber]
+		if !ok {
+			return nil, hub.Errorf(hub.CodeNotFound, "version %d of secret not found", versionNumber)
+		}
+
+		response := &proto.KVGetResponse{
+			Metadata: *version,
+		}
+
+		if version.DeletedAt != nil || version.Destroyed {
+			return response, nil
+		} else if item, err := storage().Get(kvDataDomain, kvDataKey(req.Path, versionNumber)); err != nil {
+			return nil, err
+		} else if item == nil {
+			return nil, hub.Errorf(hub.CodeNotFound, "version %d of secret not found", versionNumber)
+		} else if err := json.Unmarshal([]byte(item.Value), &response.Data); err != nil {
+			return nil, err
+		} else {
+			return response, nil
+		}
+	}
+}
+
+// updateKVVersions applies update to each of versions of the secret at path,
+// or to its current version if current is set and no versions are given,
+// and saves its metadata. Every version is checked to exist before any is
+// updated, and the versions updated before one fails are still saved.
+func updateKVVersions(path string, versions []int, current bool, update func(metadata *proto.KVMetadata, version *proto.KVVersionMetadata) error) error {
+	kvMutex.Lock()
+	defer kvMutex.Unlock()
+
+	metadata, err := loadKVMetadata(path)
+	if err != nil {
+		return err
+	} else if metadata == nil {
+		return errSecretNotFound
+	}
+
+	if len(versions) == 0 && current {
+		if metadata.CurrentVersion == 0 {
+			return errSecretNotFound
+		}
+		versions = []int{metadata.CurrentVersion}
+	} else if len(versions) == 0 {
+		return hub.NewError(hub.CodeInvalidArgument, "no versions given")
+	}
+
+	for _, versionNumber := range versions {
+		if _, ok := metadata.Versions[versionNumber]; !ok {
+			return hub.Errorf(hub.CodeNotFound, "version %d of secret not found", versionNumber)
+		}
+	}
+
+	var updateErr error
+	for _, versionNumber := range versions {
+		if updateErr = update(metadata, metadata.Versions[versionNumber]); updateErr != nil {
+			break
+		}
+	}
+
+	metadata.UpdatedAt = time.Now().UTC()
+	if err := saveKVMetadata(metadata); err != nil {
+		return err
+	}
+	return updateErr
+}
+
+func kvDelete(req *proto.KVDeleteRequest) error {
+	now := time.Now().UTC()
+	return updateKVVersions(req.Path, req.Versions, true, func(metadata *proto.KVMetadata, version *proto.KVVersionMetadata) error {
+		if version.DeletedAt == nil {
+			version.DeletedAt = &now
+		}
+		return nil
+	})
+}
+
+func kvUndelete(req *proto.KVUndeleteRequest) error {
+	return updateKVVersions(req.Path, req.Versions, false, func(metadata *proto.KVMetadata, version *proto.KVVersionMetadata) error {
+		version.DeletedAt = nil
+		return nil
+	})
+}
+
+func kvDestroy(req *proto.KVDestroyRequest) error {
+	return updateKVVersions(req.Path, req.Versions, false, func(metadata *proto.KVMetadata, version *proto.KVVersionMetadata) error {
+		if err := storage().Remove(kvDataDomain, kvDataKey(metadata.Path, version.Version)); err != nil {
+			return err
+		}
+		version.Destroyed = true
+		return nil
+	})
+}
+
+func kvMetadata(req *proto.KVMetadataRequest) (*proto.KVMetadata, error) {
+	kvMutex.Lock()
+	defer kvMutex.Unlock()
+
+	metadata, err := loadKVMetadata(req.Path)
+	if err != nil {
+		return nil, err
+	} else if req.MaxVersions == nil && req.CasRequired == nil {
+		if metadata == nil {
+			return nil, errSecretNotFound
+		}
+		return metadata, nil
+	} else if req.Path == "" {
+		return nil, hub.NewError(hub.CodeInvalidArgument, "path is required")
+	} else if metadata == nil {
+		metadata = newKVMetadata(req.Path)
+	}
+
+	if req.MaxVersions != nil {
+		if *req.MaxVersions < 0 {
+			return nil, hub.NewError(hub.CodeInvalidArgument, "max versions cannot be negative")
+		}
+		metadata.MaxVersions = *req.MaxVersions
+	}
+	if req.CasRequired != nil {
+		metadata.CasRequired = *req.CasRequired
+	}
+	metadata.UpdatedAt = time.Now().UTC()
+
+	if err := pruneKVVersions(metadata); err != nil {
+		return nil, err
+	} else if err := saveKVMetadata(metadata); err != nil {
+		return nil, err
+	} else {
+		return metadata, nil
+	}
+}
+
+func (p *userProtocol) onKVPut(req *hub.Request, kvPutRequest proto.KVPutRequest) (*proto.KVPutResponse, error) {
+	if version, err := kvPut(&kvPutRequest); err != nil {
+		return nil, err
+	} else {
+		return &proto.KVPutResponse{
+			KVVersionMetadata: *version,
+		}, nil
+	}
+}
+
+func (p *userProtocol) onKVGet(req *hub.Request, kvGetRequest proto.KVGetRequest) (*proto.KVGetResponse, error) {
+	return kvGet(&kvGetRequest)
+}
+
+func (p *userProtocol) onKVDelete(req *hub.Request, kvDeleteRequest proto.KVDeleteRequest) (interface{}, error) {
+	return nil, kvDelete(&kvDeleteRequest)
+}
+
+func (p *userProtocol) onKVUndelete(req *hub.Request, kvUndeleteRequest proto.KVUndeleteRequest) (interface{}, error) {
+	return nil, kvUndelete(&kvUndeleteRequest)
+}
+
+func (p *userProtocol) onKVDestroy(req *hub.Request, kvDestroyRequest proto.KVDestroyRequest) (interface{}, error) {
+	return nil, kvDestroy(&kvDestroyRequest)
+}
+
+func (p *userProtocol) onKVMetadata(req *hub.Request, kvMetadataRequest proto.KVMetadataRequest) (*proto.KVMetadataResponse, error) {
+	if metadata, err := kvMetadata(&kvMetadataRequest); err != nil {
+		return nil, err
+	} else {
+		return &proto.KVMetadataResponse{
+			KVMetadata: *metadata,
+		}, nil
+	}
+}
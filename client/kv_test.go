@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestKVCheckAndSet(t *testing.T) {
+	useMemoryStorage(t)
+
+	tests := []struct {
+		name        string
+		cas         *int
+		casRequired bool
+		want        int
+		fail        bool
+	}{
+		{"create without cas", nil, false, 1, false},
+		{"stale cas", intPtr(0), false, 0, true},
+		{"current cas", intPtr(1), false, 2, false},
+		{"future cas", intPtr(5), false, 0, true},
+		{"cas required", nil, true, 0, true},
+		{"cas required and given", intPtr(2), true, 3, false},
+	}
+
+	for _, test := range tests {
+		casRequired := test.casRequired
+		if _, err := kvMetadata(&proto.KVMetadataRequest{Path: "secret", CasRequired: &casRequired}); err != nil {
+			t.Fatal(err)
+		}
+
+		version, err := kvPut(&proto.KVPutRequest{Path: "secret", Data: map[string]interface{}{"step": test.name}, Cas: test.cas})
+		if test.fail {
+			if !errors.Is(err, hub.ErrFailedPrecondition) {
+				t.Errorf("%v: got %v, want failed precondition", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if version.Version != test.want {
+			t.Errorf("%v: wrote version %v, want %v", test.name, version.Version, test.want)
+		}
+	}
+
+	if secret, err := kvGet(&proto.KVGetRequest{Path: "secret"}); err != nil {
+		t.Fatal(err)
+	} else if secret.Metadata.Version != 3 || secret.Data["step"] != "cas required and given" {
+		t.Errorf("got version %v with %v", secret.Metadata.Version, secret.Data)
+	}
+
+	// a new secret is created by a check-and-set against version 0
+	if _, err := kvPut(&proto.KVPutRequest{Path: "new", Cas: intPtr(0)}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKVVersions(t *testing.T) {
+	useMemoryStorage(t)
+
+	for i := 0; i < 4; i++ {
+		if _, err := kvPut(&proto.KVPutRequest{Path: "secret", Data: map[string]interface{}{"i": i}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := kvMetadata(&proto.KVMetadataRequest{Path: "secret", MaxVersions: intPtr(3)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		op   func() error
+		fail bool
+	}{
+		{"destroy a pruned version", func() error {
+			return kvDestroy(&proto.KVDestroyRequest{Path: "secret", Versions: []int{2, 1}})
+		}, true},
+		{"delete the current version", func() error {
+			return kvDelete(&proto.KVDeleteRequest{Path: "secret"})
+		}, false},
+		{"undelete nothing", func() error {
+			return kvUndelete(&proto.KVUndeleteRequest{Path: "secret"})
+		}, true},
+		{"destroy", func() error {
+			return kvDestroy(&proto.KVDestroyRequest{Path: "secret", Versions: []int{3}})
+		}, false},
+		{"delete a missing secret", func() error {
+			return kvDelete(&proto.KVDeleteRequest{Path: "missing"})
+		}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.op(); test.fail && err == nil {
+			t.Errorf("%v: succeeded", test.name)
+		} else if !test.fail && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+	}
+
+	metadata, err := kvMetadata(&proto.KVMetadataRequest{Path: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		version   int
+		exists    bool
+		deleted   bool
+		destroyed bool
+	}{
+		{1, false, false, false},
+		{2, true, false, false},
+		{3, true, false, true},
+		{4, true, true, false},
+	} {
+		version, ok := metadata.Versions[test.version]
+		if ok != test.exists {
+			t.Errorf("version %v exists = %v, want %v", test.version, ok, test.exists)
+		} else if ok && (version.DeletedAt != nil) != test.deleted {
+			t.Errorf("version %v deleted = %v, want %v", test.version, version.DeletedAt != nil, test.deleted)
+		} else if ok && version.Destroyed != test.destroyed {
+			t.Errorf("version %v destroyed = %v, want %v", test.version, version.Destroyed, test.destroyed)
+		}
+	}
+
+	if secret, err := kvGet(&proto.KVGetRequest{Path: "secret", Version: 2}); err != nil {
+		t.Fatal(err)
+	} else if secret.Data["i"] != float64(1) {
+		t.Errorf("version 2 holds %v, want it untouched by the failed destroy", secret.Data)
+	}
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+	storagePlugin "github.com/grexie/vault/storage"
+)
+
+const policiesDomain = "policies"
+
+var errPermissionDenied = hub.NewError(hub.CodePermissionDenied, "permission denied")
+
+// requestTarget holds the fields of a request payload used to work out the
+// path it operates on.
+type requestTarget struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	MaxVersions *int   `json:"maxVersions"`
+	CasRequired *bool  `json:"casRequired"`
+}
+
+// requestPaths maps each user protocol method to the path and capability a
+// request to it needs.
+var requestPaths = map[string]func(method string, target *requestTarget) (string, proto.Capability, error){
+	"create-key":     keyPath(proto.CAPABILITY_CREATE, true),
+	"rotate-key":     keyPath(proto.CAPABILITY_UPDATE, false),
+	"set-key-config": keyPath(proto.CAPABILITY_UPDATE, false),
+	"trim-key":       keyPath(proto.CAPABILITY_UPDATE, false),
+	"delete-key":     keyPath(proto.CAPABILITY_DELETE, false),
+	"export-key":     keyPath(proto.CAPABILITY_SUDO, false),
+	"encrypt":        transitPath,
+	"decrypt":        transitPath,
+	"rewrap":         transitPath,
+	"sign":           transitPath,
+	"verify":         transitPath,
+	"hmac":           transitPath,
+	"kv-put":         kvPutPath,
+	"kv-get":         kvPath("kv/data/", proto.CAPABILITY_READ),
+	"kv-delete":      kvPath("kv/delete/", proto.CAPABILITY_UPDATE),
+	"kv-undelete":    kvPath("kv/undelete/", proto.CAPABILITY_UPDATE),
+	"kv-destroy":     kvPath("kv/destroy/", proto.CAPABILITY_UPDATE),
+	"kv-metadata":    kvMetadataPath,
+	"policy-put":     policyPath(proto.CAPABILITY_UPDATE),
+	"policy-get":     policyPath(proto.CAPABILITY_READ),
+	"policy-delete":  policyPath(proto.CAPABILITY_DELETE),
+	"policy-list": func(method string, target *requestTarget) (string, proto.Capability, error) {
+		return "sys/policies", proto.CAPABILITY_LIST, nil
+	},
+	"seal": func(method string, target *requestTarget) (string, proto.Capability, error) {
+		return "sys/seal", proto.CAPABILITY_SUDO, nil
+	},
+}
+
+// keyName returns the name of the key identified by nameOrID, as requests
+// may identify a key by either but policies name it by its name. A key that
+// does not exist keeps nameOrID, its handler failing with not found.
+func keyName(nameOrID string) (string, error) {
+	if k, err := loadKey(nameOrID); err == errKeyNotFound {
+		return nameOrID, nil
+	} else if err != nil {
+		return "", err
+	} else {
+		return k.Name, nil
+	}
+}
+
+func keyPath(capability proto.Capability, byName bool) func(string, *requestTarget) (string, proto.Capability, error) {
+	return func(method string, target *requestTarget) (string, proto.Capability, error) {
+		if byName {
+			return "keys/" + target.Name, capability, nil
+		} else if name, err := keyName(target.Key); err != nil {
+			return "", "", err
+		} else {
+			return "keys/" + name, capability, nil
+		}
+	}
+}
+
+func transitPath(method string, target *requestTarget) (string, proto.Capability, error) {
+	if name, err := keyName(target.Key); err != nil {
+		return "", "", err
+	} else {
+		return fmt.Sprintf("transit/%v/%v", method, name), proto.CAPABILITY_UPDATE, nil
+	}
+}
+
+func kvPath(prefix string, capability proto.Capability) func(string, *requestTarget) (string, proto.Capability, error) {
+	return func(method string, target *requestTarget) (string, proto.Capability, error) {
+		return prefix + target.Path, capability, nil
+	}
+}
+
+func kvPutPath(method string, target *requestTarget) (string, proto.Capability, error) {
+	if metadata, err := loadKVMetadata(target.Path); err != nil {
+		return "", "", err
+	} else if metadata == nil || metadata.CurrentVersion == 0 {
+		return "kv/data/" + target.Path, proto.CAPABILITY_CREATE, nil
+	} else {
+		return "kv/data/" + target.Path, proto.CAPABILITY_UPDATE, nil
+	}
+}
+
+func kvMetadataPath(method string, target *requestTarget) (string, proto.Capability, error) {
+	if target.MaxVersions != nil || target.CasRequired != nil {
+		return "kv/metadata/" + target.Path, proto.CAPABILITY_UPDATE, nil
+	}
+	return "kv/metadata/" + target.Path, proto.CAPABILITY_READ, nil
+}
+
+func policyPath(capability proto.Capability) func(string, *requestTarget) (string, proto.Capability, error) {
+	return func(method string, target *requestTarget) (string, proto.Capability, error) {
+		return "sys/policies/" + target.Name, capability, nil
+	}
+}
+
+func matchesPath(pattern string, p string) bool {
+	if strings.HasSuffix(pattern, "*") && strings.HasPrefix(p, strings.TrimSuffix(pattern, "*")) {
+		return true
+	}
+	matched, err := path.Match(pattern, p)
+	return err == nil && matched
+}
+
+func validatePolicy(policy *proto.Policy) error {
+	if policy.Name == "" {
+		return hub.NewError(hub.CodeInvalidArgument, "policy name is required")
+	}
+
+	for _, rule := range policy.Rules {
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return hub.Errorf(hub.CodeInvalidArgument, "invalid path \"%v\": %v", rule.Path, err)
+		}
+		for _, capability := range rule.Capabilities {
+			switch capability {
+			case proto.CAPABILITY_READ, proto.CAPABILITY_CREATE, proto.CAPABILITY_UPDATE, proto.CAPABILITY_DELETE, proto.CAPABILITY_LIST, proto.CAPABILITY_SUDO, proto.CAPABILITY_DENY:
+			default:
+				return hub.Errorf(hub.CodeInvalidArgument, "unknown capability \"%v\"", capability)
+			}
+		}
+	}
+
+	return nil
+}
+
+func listPolicies() ([]*proto.Policy, error) {
+	policies := []*proto.Policy{}
+
+	var cursor storagePlugin.Cursor
+	for {
+		if page, err := storage().List(policiesDomain, cursor); err != nil {
+			return nil, err
+		} else {
+			for _, item := range page.Items {
+				var policy proto.Policy
+				if err := json.Unmarshal([]byte(item.Value), &policy); err != nil {
+					return nil, err
+				}
+				policies = append(policies, &policy)
+			}
+
+			if page.Next == nil {
+				return policies, nil
+			}
+			cursor = page.Next
+		}
+	}
+}
+
+func isRootUser(identity *proto.PeerIdentity) bool {
+	for _, name := range strings.Split(*rootUsers, ",") {
+		if name = strings.TrimSpace(name); name != "" && name == identity.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether identity holds capability on p. Capabilities are
+// the union of every matching rule of every policy naming the identity,
+// except that a matching deny always wins.
+func allowed(identity *proto.PeerIdentity, p string, capability proto.Capability) (bool, error) {
+	if isRootUser(identity) {
+		return true, nil
+	}
+
+	policies, err := listPolicies()
+	if err != nil {
+		return false, err
+	}
+
+	granted := false
+	for _, policy := range policies {
+		applies := false
+		for _, name := range policy.Identities {
+			if name == "*" || name == identity.Name {
+				applies = true
+			}
+		}
+		if !applies {
+			continue
+		}
+
+		for _, rule := range policy.Rules {
+			if !matchesPath(rule.Path, p) {
+				continue
+			}
+			for _, c := range rule.Capabilities {
+				if c == proto.CAPABILITY_DENY {
+					return false, nil
+				} else if c == capability {
+					granted = true
+				}
+			}
+		}
+	}
+
+	return granted, nil
+}
+
+// authorize runs before every handler of the user protocol and rejects
+// requests the identity of the peer holds no policy for. The seal methods
+// are exempt, as policies cannot be read while the vault is sealed.
+func (p *userProtocol) authorize(res hub.ResponseWriter, req *hub.Request) error {
+	if sealMethods[req.Method] {
+		return nil
+	} else if requestPath, ok := requestPaths[req.Method]; !ok {
+		return errPermissionDenied
+	} else if target, err := hub.Decode[requestTarget](req); err != nil {
+		return err
+	} else if path, capability, err := requestPath(req.Method, &target); err != nil {
+		return err
+	} else if ok, err := allowed(p.identity, path, capability); err != nil {
+		return err
+	} else if !ok {
+		return errPermissionDenied
+	} else {
+		return nil
+	}
+}
+
+func (p *userProtocol) onPolicyPut(req *hub.Request, policyPutRequest proto.PolicyPutRequest) (interface{}, error) {
+	if err := validatePolicy(&policyPutRequest.Policy); err != nil {
+		return nil, err
+	} else if bytes, err := json.Marshal(&policyPutRequest.Policy); err != nil {
+		return nil, err
+	} else {
+		return nil, storage().Set(policiesDomain, policyPutRequest.Name, string(bytes))
+	}
+}
+
+func (p *userProtocol) onPolicyGet(req *hub.Request, policyGetRequest proto.PolicyGetRequest) (*proto.PolicyGetResponse, error) {
+	var policy proto.Policy
+
+	if item, err := storage().Get(policiesDomain, policyGetRequest.Name); err != nil {
+		return nil, err
+	} else if item == nil {
+		return nil, hub.NewError(hub.CodeNotFound, "policy not found")
+	} else if err := json.Unmarshal([]byte(item.Value), &policy); err != nil {
+		return nil, err
+	} else {
+		return &proto.PolicyGetResponse{
+			Policy: policy,
+		}, nil
+	}
+}
+
+func (p *userProtocol) onPolicyList(req *hub.Request, _ interface{}) (*proto.PolicyListResponse, error) {
+	if policies, err := listPolicies(); err != nil {
+		return nil, err
+	} else {
+		names := []string{}
+		for _, policy := range policies {
+			names = append(names, policy.Name)
+		}
+
+		return &proto.PolicyListResponse{
+			Names: names,
+		}, nil
+	}
+}
+
+func (p *userProtocol) onPolicyDelete(req *hub.Request, policyDeleteRequest proto.PolicyDeleteRequest) (interface{}, error) {
+	return nil, storage().Remove(policiesDomain, policyDeleteRequest.Name)
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"encoding/json"
+	"flag"
+	"sync"
+	"testing"
+
+	proto "github.com/grexie/vault/protocol"
+	"github.com/grexie/vault/storage/memory"
+)
+
+var defineFlags = sync.Once{}
+
+// useDefaultFlags defines the flags with their defaults, once as goroutines
+// left running by earlier tests read them.
+func useDefaultFlags() {
+	defineFlags.Do(func() {
+		newFlagSet(flag.ContinueOnError)
+	})
+	*masterKeyPath = ""
+}
+
+// useMemoryStorage backs storage with an empty memory driver.
+func useMemoryStorage(t *testing.T) {
+	t.Helper()
+
+	useDefaultFlags()
+	driver := &memory.MemoryDriver{}
+	if err := driver.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	setStorage(driver)
+}
+
+func putPolicy(t *testing.T, policy proto.Policy) {
+	t.Helper()
+
+	if bytes, err := json.Marshal(&policy); err != nil {
+		t.Fatal(err)
+	} else if err := storage().Set(policiesDomain, policy.Name, string(bytes)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchesPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"keys/*", "keys/a", true},
+		{"keys/*", "keys/a/b", true},
+		{"keys/a", "keys/a", true},
+		{"keys/a", "keys/b", false},
+		{"transit/*/a", "transit/encrypt/a", true},
+		{"transit/*/a", "transit/encrypt/b", false},
+		{"kv/data/?", "kv/data/x", true},
+		{"kv/data/*", "kv/metadata/x", false},
+	}
+
+	for _, test := range tests {
+		if got := matchesPath(test.pattern, test.path); got != test.want {
+			t.Errorf("matchesPath(%q, %q) = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestKeyPolicyByID(t *testing.T) {
+	useMemoryStorage(t)
+
+	denied, err := createKey(&proto.CreateKeyRequest{Name: "denied", Type: proto.KEY_TYPE_AES256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted, err := createKey(&proto.CreateKeyRequest{Name: "granted", Type: proto.KEY_TYPE_AES256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putPolicy(t, proto.Policy{
+		Name:       "keys",
+		Identities: []string{"alice"},
+		Rules: []proto.PolicyRule{
+			{Path: "keys/*", Capabilities: []proto.Capability{proto.CAPABILITY_UPDATE, proto.CAPABILITY_DELETE}},
+			{Path: "transit/*", Capabilities: []proto.Capability{proto.CAPABILITY_UPDATE}},
+			{Path: "keys/denied", Capabilities: []proto.Capability{proto.CAPABILITY_DENY}},
+			{Path: "transit/*/denied", Capabilities: []proto.Capability{proto.CAPABILITY_DENY}},
+		},
+	})
+
+	tests := []struct {
+		method string
+		key    string
+		want   bool
+	}{
+		{"encrypt", "denied", false},
+		{"encrypt", denied.ID, false},
+		{"sign", denied.ID, false},
+		{"rotate-key", "denied", false},
+		{"rotate-key", denied.ID, false},
+		{"delete-key", denied.ID, false},
+		{"encrypt", "granted", true},
+		{"encrypt", granted.ID, true},
+		{"rotate-key", granted.ID, true},
+	}
+
+	identity := &proto.PeerIdentity{Name: "alice"}
+	for _, test := range tests {
+		if path, capability, err := requestPaths[test.method](test.method, &requestTarget{Key: test.key}); err != nil {
+			t.Errorf("%v %v: %v", test.method, test.key, err)
+		} else if got, err := allowed(identity, path, capability); err != nil {
+			t.Errorf("%v %v: %v", test.method, test.key, err)
+		} else if got != test.want {
+			t.Errorf("%v %v on %v: allowed = %v, want %v", test.method, test.key, path, got, test.want)
+		}
+	}
+}
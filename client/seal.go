@@ -0,0 +1,376 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+	sealPlugin "github.com/grexie/vault/seal"
+	"github.com/grexie/vault/shamir"
+	storagePlugin "github.com/grexie/vault/storage"
+	"github.com/grexie/vault/storage/encrypted"
+)
+
+// sealDomain holds the seal configuration and the master key wrapped with
+// the unseal key. It lives in the underlying driver, outside of the
+// encrypted driver.
+const sealDomain = "seal"
+
+// shamirSeal is the name of the default seal, which has no external key and
+// is only unsealed by submitting unseal key shares.
+const shamirSeal = "shamir"
+
+var errSealed = hub.NewError(hub.CodeSealed, "vault is sealed")
+
+// rawStorage is the underlying storage driver. storage is only backed by it
+// once the vault is unsealed; while sealed every operation fails. Handlers
+// run concurrently with sealing and unsealing, so storage is only accessed
+// through storage and setStorage.
+var rawStorage storagePlugin.Driver
+var storageDriver storagePlugin.Driver
+var storageMutex = sync.RWMutex{}
+var sealMutex = sync.Mutex{}
+var unsealShares = [][]byte{}
+
+// autoSeal wraps the master key so that the vault unseals itself on boot. It
+// is nil when the vault is sealed with Shamir shares alone.
+var autoSeal sealPlugin.Seal
+
+// methods that can be called while sealed and that do not need a policy.
+var sealMethods = map[string]bool{
+	"init":        true,
+	"unseal":      true,
+	"seal-status": true,
+}
+
+type sealConfig struct {
+	Shares    int `json:"shares"`
+	Threshold int `json:"threshold"`
+}
+
+type sealedDriver struct{}
+
+func (d *sealedDriver) CreateFlags(flagSet *flag.FlagSet) error { return nil }
+func (d *sealedDriver) Initialize() error                       { return nil }
+func (d *sealedDriver) List(domain string, cursor storagePlugin.Cursor) (*storagePlugin.Page, error) {
+	return nil, errSealed
+}
+func (d *sealedDriver) Get(domain string, key string) (*storagePlugin.Item, error) {
+	return nil, errSealed
+}
+func (d *sealedDriver) Set(domain string, key string, value string) error { return errSealed }
+func (d *sealedDriver) Remove(domain string, key string) error            { return errSealed }
+func (d *sealedDriver) Flush(domain string) error                         { return errSealed }
+
+// storage returns the driver the vault is currently backed by.
+func storage() storagePlugin.Driver {
+	storageMutex.RLock()
+	defer storageMutex.RUnlock()
+
+	return storageDriver
+}
+
+func setStorage(driver storagePlugin.Driver) {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	storageDriver = driver
+}
+
+func isSealed() bool {
+	_, sealed := storage().(*sealedDriver)
+	return sealed
+}
+
+func loadSealConfig() (*sealConfig, error) {
+	var config sealConfig
+
+	if item, err := rawStorage.Get(sealDomain, "config"); err != nil {
+		return nil, err
+	} else if item == nil {
+		return nil, nil
+	} else if err := json.Unmarshal([]byte(item.Value), &config); err != nil {
+		return nil, err
+	} else {
+		return &config, nil
+	}
+}
+
+func newUnsealAEAD(unsealKey []byte) (cipher.AEAD, error) {
+	if block, err := aes.NewCipher(unsealKey); err != nil {
+		return nil, err
+	} else {
+		return cipher.NewGCM(block)
+	}
+}
+
+// initialize generates the master key and the unseal key protecting it, and
+// splits the unseal key into shares. The vault stays sealed unless an auto
+// seal is configured, in which case the shares serve as recovery keys.
+func initialize(shares int, threshold int) ([][]byte, error) {
+	sealMutex.Lock()
+	defer sealMutex.Unlock()
+
+	if config, err := loadSealConfig(); err != nil {
+		return nil, err
+	} else if config != nil {
+		return nil, hub.NewError(hub.CodeFailedPrecondition, "vault is already initialized")
+	}
+
+	masterKey, err := initialMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	unsealKey, err := encrypted.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := shamir.Split(unsealKey, shares, threshold)
+	if err != nil {
+		return nil, hub.NewError(hub.CodeInvalidArgument, err.Error())
+	}
+
+	aead, err := newUnsealAEAD(unsealKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	keyring := aead.Seal(nonce, nonce, masterKey, []byte(sealDomain))
+
+	if bytes, err := json.Marshal(&sealConfig{Shares: shares, Threshold: threshold}); err != nil {
+		return nil, err
+	} else if err := rawStorage.Set(sealDomain, "keyring", base64.StdEncoding.EncodeToString(keyring)); err != nil {
+		return nil, err
+	} else if err := rawStorage.Set(sealDomain, "config", string(bytes)); err != nil {
+		return nil, err
+	}
+
+	log.Println("vault initialized")
+
+	if autoSeal != nil {
+		if err := unsealWithMasterKey(masterKey); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// initialMasterKey returns the master key of a new vault. Vaults created
+// before sealing was added were encrypted with the master key of a file, so
+// their storage already holds data keys: init adopts the key of -master-key
+// for them, and refuses to initialize without it rather than orphan the data.
+func initialMasterKey() ([]byte, error) {
+	if page, err := rawStorage.List(encrypted.KeyringDomain, nil); err != nil {
+		return nil, err
+	} else if *masterKeyPath == "" {
+		if len(page.Items) > 0 {
+			return nil, hub.NewError(hub.CodeFailedPrecondition, "storage holds data encrypted with a master key file, set -master-key to adopt it")
+		}
+		return encrypted.GenerateKey()
+	} else if masterKey, err := encrypted.ReadMasterKey(*masterKeyPath); err != nil {
+		return nil, err
+	} else if err := encrypted.VerifyMasterKey(rawStorage, masterKey); err != nil {
+		return nil, hub.Errorf(hub.CodeInvalidArgument, "-master-key does not decrypt the stored data: %v", err)
+	} else {
+		log.Println("adopting the master key of", *masterKeyPath)
+		return masterKey, nil
+	}
+}
+
+// saveAutoKeyring stores the master key wrapped by the auto seal, so that the
+// next boot can unseal without shares.
+func saveAutoKeyring(masterKey []byte) error {
+	if wrapped, err := autoSeal.Wrap(masterKey); err != nil {
+		return err
+	} else {
+		return rawStorage.Set(sealDomain, "auto-keyring", base64.StdEncoding.EncodeToString(wrapped))
+	}
+}
+
+// unsealWithMasterKey backs storage with the encrypted driver. When an auto
+// seal is configured it also wraps the master key with it, which migrates a
+// vault unsealed with shares to auto unseal.
+func unsealWithMasterKey(masterKey []byte) error {
+	driver, err := encrypted.NewDriver(rawStorage, masterKey)
+	if err != nil {
+		return err
+	}
+
+	if autoSeal != nil {
+		if item, err := rawStorage.Get(sealDomain, "auto-keyring"); err != nil {
+			return err
+		} else if item == nil {
+			if err := saveAutoKeyring(masterKey); err != nil {
+				return err
+			}
+		}
+	}
+
+	setStorage(driver)
+	log.Println("vault unsealed")
+	go writeStatusFile()
+	return nil
+}
+
+// unsealWithKey decrypts the master key with unsealKey and unseals the vault
+// with it.
+func unsealWithKey(unsealKey []byte) error {
+	if item, err := rawStorage.Get(sealDomain, "keyring"); err != nil {
+		return err
+	} else if item == nil {
+		return hub.NewError(hub.CodeFailedPrecondition, "vault is not initialized")
+	} else if keyring, err := base64.StdEncoding.DecodeString(item.Value); err != nil {
+		return err
+	} else if aead, err := newUnsealAEAD(unsealKey); err != nil {
+		return err
+	} else if len(keyring) < aead.NonceSize() {
+		return errors.New("invalid keyring")
+	} else if masterKey, err := aead.Open(nil, keyring[:aead.NonceSize()], keyring[aead.NonceSize():], []byte(sealDomain)); err != nil {
+		return hub.NewError(hub.CodeInvalidArgument, "invalid unseal key")
+	} else {
+		return unsealWithMasterKey(masterKey)
+	}
+}
+
+// autoUnseal unwraps the master key with the auto seal. A vault that is not
+// initialized yet, or that has never been unsealed since the auto seal was
+// configured, stays sealed.
+func autoUnseal() error {
+	sealMutex.Lock()
+	defer sealMutex.Unlock()
+
+	if autoSeal == nil {
+		return nil
+	} else if item, err := rawStorage.Get(sealDomain, "auto-keyring"); err != nil {
+		return err
+	} else if item == nil {
+		log.Println("vault sealed, submit unseal key shares to enable auto unseal")
+		return nil
+	} else if wrapped, err := base64.StdEncoding.DecodeString(item.Value); err != nil {
+		return err
+	} else if masterKey, err := autoSeal.Unwrap(wrapped); err != nil {
+		return err
+	} else {
+		return unsealWithMasterKey(masterKey)
+	}
+}
+
+func unseal(share []byte) error {
+	sealMutex.Lock()
+	defer sealMutex.Unlock()
+
+	if !isSealed() {
+		return nil
+	}
+
+	config, err := loadSealConfig()
+	if err != nil {
+		return err
+	} else if config == nil {
+		return hub.NewError(hub.CodeFailedPrecondition, "vault is not initialized")
+	}
+
+	unsealShares = append(unsealShares, share)
+	if len(unsealShares) < config.Threshold {
+		return nil
+	}
+
+	shares := unsealShares
+	unsealShares = [][]byte{}
+
+	if unsealKey, err := shamir.Combine(shares); err != nil {
+		return hub.NewError(hub.CodeInvalidArgument, err.Error())
+	} else {
+		return unsealWithKey(unsealKey)
+	}
+}
+
+func seal() {
+	sealMutex.Lock()
+	defer sealMutex.Unlock()
+
+	setStorage(&sealedDriver{})
+	unsealShares = [][]byte{}
+	log.Println("vault sealed")
+	go writeStatusFile()
+}
+
+func sealStatus() (*proto.SealStatusResponse, error) {
+	sealMutex.Lock()
+	defer sealMutex.Unlock()
+
+	if config, err := loadSealConfig(); err != nil {
+		return nil, err
+	} else if config == nil {
+		return &proto.SealStatusResponse{Type: *sealName, Sealed: true}, nil
+	} else {
+		return &proto.SealStatusResponse{
+			Type:        *sealName,
+			Initialized: true,
+			Sealed:      isSealed(),
+			Shares:      config.Shares,
+			Threshold:   config.Threshold,
+			Progress:    len(unsealShares),
+		}, nil
+	}
+}
+
+// checkSealed runs before every handler of the user protocol and refuses
+// everything but the seal methods while the vault is sealed.
+func (p *userProtocol) checkSealed(res hub.ResponseWriter, req *hub.Request) error {
+	if !sealMethods[req.Method] && isSealed() {
+		return errSealed
+	}
+	return nil
+}
+
+func (p *userProtocol) onInit(req *hub.Request, initRequest proto.InitRequest) (*proto.InitResponse, error) {
+	if parts, err := initialize(initRequest.Shares, initRequest.Threshold); err != nil {
+		return nil, err
+	} else {
+		shares := []string{}
+		for _, part := range parts {
+			shares = append(shares, base64.StdEncoding.EncodeToString(part))
+		}
+
+		return &proto.InitResponse{
+			Shares: shares,
+		}, nil
+	}
+}
+
+func (p *userProtocol) onUnseal(req *hub.Request, unsealRequest proto.UnsealRequest) (*proto.SealStatusResponse, error) {
+	if unsealRequest.Reset {
+		sealMutex.Lock()
+		unsealShares = [][]byte{}
+		sealMutex.Unlock()
+	} else if share, err := base64.StdEncoding.DecodeString(unsealRequest.Share); err != nil {
+		return nil, err
+	} else if err := unseal(share); err != nil {
+		return nil, err
+	}
+
+	return sealStatus()
+}
+
+func (p *userProtocol) onSeal(req *hub.Request, _ interface{}) (interface{}, error) {
+	seal()
+	return nil, nil
+}
+
+func (p *userProtocol) onSealStatus(req *hub.Request, _ interface{}) (*proto.SealStatusResponse, error) {
+	return sealStatus()
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grexie/vault/hub"
+	"github.com/grexie/vault/storage/encrypted"
+	"github.com/grexie/vault/storage/memory"
+)
+
+// useSealedStorage backs the vault with an empty sealed memory driver.
+func useSealedStorage(t *testing.T) {
+	t.Helper()
+
+	useDefaultFlags()
+	driver := &memory.MemoryDriver{}
+	if err := driver.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	rawStorage = driver
+	autoSeal = nil
+	unsealShares = [][]byte{}
+	setStorage(&sealedDriver{})
+}
+
+func TestInitializeAndUnseal(t *testing.T) {
+	useSealedStorage(t)
+
+	shares, err := initialize(5, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(shares) != 5 {
+		t.Fatalf("got %v shares, want 5", len(shares))
+	}
+
+	for i, share := range shares[2:] {
+		if !isSealed() {
+			t.Fatalf("unsealed after %v shares", i)
+		} else if err := unseal(share); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if isSealed() {
+		t.Fatal("still sealed after 3 shares")
+	}
+
+	if err := storage().Set("test", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	seal()
+	if _, err := storage().Get("test", "key"); !errors.Is(err, hub.ErrSealed) {
+		t.Fatalf("got %v, want sealed", err)
+	}
+}
+
+// TestInitializeAdoptsMasterKey initializes a vault over data written with a
+// master key file, as vaults created before sealing was added were.
+func TestInitializeAdoptsMasterKey(t *testing.T) {
+	useSealedStorage(t)
+
+	masterKey, err := encrypted.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if driver, err := encrypted.NewDriver(rawStorage, masterKey); err != nil {
+		t.Fatal(err)
+	} else if err := driver.Set("test", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := initialize(2, 2); !errors.Is(err, hub.ErrFailedPrecondition) {
+		t.Fatalf("got %v, want initialization without -master-key to fail", err)
+	}
+
+	otherKey, _ := encrypted.GenerateKey()
+	for _, test := range []struct {
+		key  []byte
+		fail bool
+	}{
+		{otherKey, true},
+		{masterKey, false},
+	} {
+		*masterKeyPath = filepath.Join(t.TempDir(), "master.key")
+		if err := os.WriteFile(*masterKeyPath, []byte(base64.StdEncoding.EncodeToString(test.key)), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		shares, err := initialize(2, 2)
+		if test.fail {
+			if err == nil {
+				t.Fatal("initialized with the wrong master key")
+			}
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		} else if err := unseal(shares[0]); err != nil {
+			t.Fatal(err)
+		} else if err := unseal(shares[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if item, err := storage().Get("test", "key"); err != nil {
+		t.Fatal(err)
+	} else if item == nil || item.Value != "value" {
+		t.Fatalf("got %v, want the value written before the migration", item)
+	}
+}
+
+func TestInitializeThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		shares    int
+		threshold int
+		want      error
+	}{
+		{"single operator", 1, 1, nil},
+		{"any one of three", 3, 1, nil},
+		{"threshold above shares", 2, 3, hub.ErrInvalidArgument},
+		{"threshold of zero", 2, 0, hub.ErrInvalidArgument},
+		{"too many shares", 256, 2, hub.ErrInvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useSealedStorage(t)
+
+			shares, err := initialize(test.shares, test.threshold)
+			if test.want != nil {
+				if !errors.Is(err, test.want) {
+					t.Fatalf("got %v, want %v", err, test.want)
+				} else if status, err := sealStatus(); err != nil {
+					t.Fatal(err)
+				} else if status.Initialized {
+					t.Fatal("initialized after failing")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := unseal(shares[len(shares)-1]); err != nil {
+				t.Fatal(err)
+			} else if isSealed() {
+				t.Fatalf("still sealed after %v share", test.threshold)
+			}
+		})
+	}
+}
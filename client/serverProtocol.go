@@ -1,68 +1,157 @@
 package client
 
 import (
-	"encoding/json"
-	"errors"
 	"log"
+	"strings"
 	"sync"
 
+	"github.com/gorilla/websocket"
 	"github.com/grexie/vault/hub"
 	proto "github.com/grexie/vault/protocol"
 	"github.com/grexie/vault/webrtc"
 	webrtc2 "github.com/pion/webrtc/v3"
 )
 
+// serverProtocol outlives the connections to the server, so that the peers
+// of a session resumed after a reconnect carry on.
 type serverProtocol struct {
 	sync.Mutex
-	hub        *hub.Hub
-	ICEServers []string
-	peers      map[string]*webrtc.PeerConnection
+	hub         *hub.Hub
+	conn        *websocket.Conn
+	ICEServers  []webrtc2.ICEServer
+	resumeToken string
+	peers       map[string]*webrtc.PeerConnection
 }
 
-func newServerProtocol(hub *hub.Hub) (*serverProtocol, error) {
-	p := &serverProtocol{
-		hub:   hub,
+func newServerProtocol() *serverProtocol {
+	return &serverProtocol{
 		peers: map[string]*webrtc.PeerConnection{},
 	}
+}
 
-	hub.Handle("create-peer", p.onCreatePeer)
-	hub.Handle("delete-peer", p.onDeletePeer)
+// attach makes h on c the connection to the server, before Start connects
+// on it.
+func (p *serverProtocol) attach(c *websocket.Conn, h *hub.Hub) {
+	p.Lock()
+	p.conn = c
+	p.hub = h
+	p.Unlock()
 
-	return p, nil
+	hub.HandleTyped(h, "create-peer", p.onCreatePeer)
+	hub.HandleTyped(h, "delete-peer", p.onDeletePeer)
 }
 
-func (p *serverProtocol) Done() {
+func (p *serverProtocol) signalling() *hub.Hub {
+	p.Lock()
+	defer p.Unlock()
 
+	return p.hub
 }
 
+func parseLabels(s string) map[string]string {
+	labels := map[string]string{}
+	for _, label := range strings.Split(s, ",") {
+		if parts := strings.SplitN(strings.TrimSpace(label), "=", 2); len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		}
+	}
+	return labels
+}
+
+// Start connects on the attached connection. A connection that fails to
+// connect is closed, so that the client reconnects after backing off rather
+// than idling on it.
 func (p *serverProtocol) Start() {
-	p.hub.Request("connect", &proto.ConnectRequest{
-		Type: proto.CONNECT_TYPE_SERVICE,
-	}, func(res interface{}, err error) {
+	p.Lock()
+	c, h := p.conn, p.hub
+	p.Unlock()
+
+	credential, err := p.credential()
+	if err != nil {
+		log.Println(err)
+		c.Close()
+		return
+	}
+
+	p.Lock()
+	resumeToken := p.resumeToken
+	previousPeers := []string{}
+	for id := range p.peers {
+		previousPeers = append(previousPeers, id)
+	}
+	p.Unlock()
+
+	if connectResponse, err := hub.Call[proto.ConnectResponse](h, "connect", &proto.ConnectRequest{
+		Version:     proto.PROTOCOL_VERSION,
+		Features:    proto.Features,
+		Type:        proto.CONNECT_TYPE_SERVICE,
+		Credential:  credential,
+		Labels:      parseLabels(*labels),
+		ResumeToken: resumeToken,
+	}); err != nil {
+		log.Println("connect:", err)
+		c.Close()
+	} else if _, ok := proto.NegotiateVersion(connectResponse.Version); !ok {
+		log.Printf("connect: unsupported server protocol version %v, the client speaks versions %v to %v", connectResponse.Version, proto.MIN_PROTOCOL_VERSION, proto.PROTOCOL_VERSION)
+		c.Close()
+	} else {
+		p.Lock()
+		p.ICEServers = connectResponse.ICEServers
+		p.resumeToken = ""
+		if proto.HasFeature(connectResponse.Features, proto.FEATURE_RESUME) {
+			p.resumeToken = connectResponse.ResumeToken
+		}
+		p.Unlock()
 
-		var connectResponse proto.ConnectResponse
-		if bytes, err := json.Marshal(res); err != nil {
-		} else if err := json.Unmarshal(bytes, &connectResponse); err != nil {
+		p.resumePeers(h, previousPeers, connectResponse)
+		connectionEstablished()
+		log.Println("connected, protocol version", connectResponse.Version)
+	}
+}
+
+// resumePeers moves the peers that survived a resumed session over to h, and
+// closes the peers of the previous connection that the server deleted.
+func (p *serverProtocol) resumePeers(h *hub.Hub, previousPeers []string, connectResponse proto.ConnectResponse) {
+	live := map[string]bool{}
+	if connectResponse.Resumed {
+		for _, id := range connectResponse.Peers {
+			live[id] = true
+		}
+		log.Println("resumed session with", len(connectResponse.Peers), "peers")
+	}
+
+	for _, id := range previousPeers {
+		p.Lock()
+		peer, ok := p.peers[id]
+		p.Unlock()
+
+		if !ok {
+			continue
+		} else if live[id] {
+			peer.SetSignalling(h)
 		} else {
-			p.ICEServers = connectResponse.ICEServers
-			log.Println("connected")
+			p.deletePeer(id)
 		}
-	})
+	}
 }
 
-func (p *serverProtocol) onCreatePeer(res hub.ResponseWriter, req *hub.Request) error {
-	var createPeerRequest proto.CreatePeerRequest
-	if bytes, err := json.Marshal(req.Payload); err != nil {
-		return err
-	} else if err := json.Unmarshal(bytes, &createPeerRequest); err != nil {
-		return err
-	} else if peer, err := webrtc.NewPeerConnection(createPeerRequest.ID, p.ICEServers, p.hub); err != nil {
-		return err
+func (p *serverProtocol) onCreatePeer(req *hub.Request, createPeerRequest proto.CreatePeerRequest) (*proto.CreatePeerResponse, error) {
+	// servers older than the credentials minted for every peer only hand out
+	// those of the connection
+	iceServers := createPeerRequest.ICEServers
+	if len(iceServers) == 0 {
+		p.Lock()
+		iceServers = p.ICEServers
+		p.Unlock()
+	}
+
+	if peer, err := webrtc.NewPeerConnection(createPeerRequest.ID, iceServers, req.Hub, hub.NegotiateCodec(createPeerRequest.Codecs)); err != nil {
+		return nil, err
 	} else {
 		peer.OnConnectionStateChange(func(c webrtc2.PeerConnectionState) {
 			if c == webrtc2.PeerConnectionStateClosed {
 				if err := p.deletePeer(createPeerRequest.ID); err == nil {
-					p.hub.RequestWithoutResponse("delete-peer", &proto.DeletePeerRequest{
+					p.signalling().RequestWithoutResponse("delete-peer", &proto.DeletePeerRequest{
 						ID: createPeerRequest.ID,
 					})
 				}
@@ -73,15 +162,15 @@ func (p *serverProtocol) onCreatePeer(res hub.ResponseWriter, req *hub.Request)
 		p.peers[createPeerRequest.ID] = peer
 		p.Unlock()
 
-		if err := startUserProtocol(peer.Hub); err != nil {
-			return err
+		if err := startUserProtocol(peer.Hub, createPeerRequest.User); err != nil {
+			return nil, err
 		} else if offer, err := peer.CreateOffer(); err != nil {
-			return err
+			return nil, err
 		} else {
-			return res.Write(&proto.CreatePeerResponse{
+			return &proto.CreatePeerResponse{
 				ID:                 peer.ID,
 				SessionDescription: offer,
-			})
+			}, nil
 		}
 	}
 }
@@ -91,21 +180,13 @@ func (p *serverProtocol) deletePeer(id string) error {
 	defer p.Unlock()
 
 	if peer, ok := p.peers[id]; !ok {
-		return errors.New("peer not found")
+		return hub.NewError(hub.CodeNotFound, "peer not found")
 	} else {
 		delete(p.peers, id)
 		return peer.Close()
 	}
 }
 
-func (p *serverProtocol) onDeletePeer(res hub.ResponseWriter, req *hub.Request) error {
-	var deletePeerRequest proto.DeletePeerRequest
-
-	if bytes, err := json.Marshal(req.Payload); err != nil {
-		return err
-	} else if err := json.Unmarshal(bytes, &deletePeerRequest); err != nil {
-		return err
-	} else {
-		return p.deletePeer(deletePeerRequest.ID)
-	}
+func (p *serverProtocol) onDeletePeer(req *hub.Request, deletePeerRequest proto.DeletePeerRequest) (interface{}, error) {
+	return nil, p.deletePeer(deletePeerRequest.ID)
 }
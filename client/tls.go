@@ -0,0 +1,42 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// loadTLSConfig returns the TLS configuration wss:// connections are dialed
+// with, or nil to use the system roots without a client certificate. It is
+// called for every connection attempt, so rotated certificates are used from
+// the next reconnect on.
+func loadTLSConfig() (*tls.Config, error) {
+	if *caCert == "" && *tlsCert == "" && *tlsKey == "" {
+		return nil, nil
+	} else if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if *caCert != "" {
+		if bytes, err := os.ReadFile(*caCert); err != nil {
+			return nil, err
+		} else if pool := x509.NewCertPool(); !pool.AppendCertsFromPEM(bytes) {
+			return nil, fmt.Errorf("no certificates found in %v", *caCert)
+		} else {
+			config.RootCAs = pool
+		}
+	}
+
+	if *tlsCert != "" {
+		if certificate, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+			return nil, err
+		} else {
+			config.Certificates = []tls.Certificate{certificate}
+		}
+	}
+
+	return config, nil
+}
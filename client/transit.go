@@ -0,0 +1,341 @@
+package client
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+const versionPrefix = "vault:v"
+
+var errUnsupportedOperation = hub.NewError(hub.CodeInvalidArgument, "operation not supported by key type")
+
+// encodeVersioned prefixes value with the key version that produced it.
+func encodeVersioned(version int, value []byte) string {
+	return fmt.Sprintf("%v%d:%v", versionPrefix, version, base64.StdEncoding.EncodeToString(value))
+}
+
+// decodeVersioned splits a value produced by encodeVersioned into the key
+// version and the decoded value.
+func decodeVersioned(value string) (int, []byte, error) {
+	if !strings.HasPrefix(value, versionPrefix) {
+		return 0, nil, hub.NewError(hub.CodeInvalidArgument, "invalid value: missing version prefix")
+	} else if parts := strings.SplitN(strings.TrimPrefix(value, versionPrefix), ":", 2); len(parts) != 2 {
+		return 0, nil, hub.NewError(hub.CodeInvalidArgument, "invalid value: missing version prefix")
+	} else if version, err := strconv.Atoi(parts[0]); err != nil || version < 1 {
+		return 0, nil, hub.NewError(hub.CodeInvalidArgument, "invalid value: invalid key version")
+	} else if bytes, err := base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return 0, nil, err
+	} else {
+		return version, bytes, nil
+	}
+}
+
+func decodeBase64(name string, value string) ([]byte, error) {
+	if bytes, err := base64.StdEncoding.DecodeString(value); err != nil {
+		return nil, hub.Errorf(hub.CodeInvalidArgument, "%v must be base64 encoded: %v", name, err)
+	} else {
+		return bytes, nil
+	}
+}
+
+func newHash(algorithm proto.HashAlgorithm) (crypto.Hash, error) {
+	switch algorithm {
+	case "", proto.HASH_ALGORITHM_SHA2_256:
+		return crypto.SHA256, nil
+	case proto.HASH_ALGORITHM_SHA2_384:
+		return crypto.SHA384, nil
+	case proto.HASH_ALGORITHM_SHA2_512:
+		return crypto.SHA512, nil
+	default:
+		return 0, hub.Errorf(hub.CodeInvalidArgument, "unsupported hash algorithm \"%v\"", algorithm)
+	}
+}
+
+func (k *key) version(version int) (*keyVersion, error) {
+	if v, ok := k.Versions[version]; !ok {
+		return nil, hub.Errorf(hub.CodeNotFound, "key version %d not found", version)
+	} else {
+		return v, nil
+	}
+}
+
+// encryptionVersion returns the version used to encrypt, sign or HMAC new
+// values, which is the latest version unless requested is set.
+func (k *key) encryptionVersion(requested int) (*keyVersion, error) {
+	if requested == 0 {
+		requested = k.LatestVersion
+	}
+
+	if requested < k.MinEncryptionVersion {
+		return nil, hub.Errorf(hub.CodeInvalidArgument, "key version %d is below the minimum encryption version %d", requested, k.MinEncryptionVersion)
+	} else if requested < k.MinDecryptionVersion {
+		return nil, hub.Errorf(hub.CodeInvalidArgument, "key version %d is below the minimum decryption version %d", requested, k.MinDecryptionVersion)
+	}
+	return k.version(requested)
+}
+
+// decryptionVersion returns the version used to decrypt or verify a value
+// produced by version.
+func (k *key) decryptionVersion(version int) (*keyVersion, error) {
+	if version < k.MinDecryptionVersion {
+		return nil, hub.Errorf(hub.CodeInvalidArgument, "key version %d is below the minimum decryption version %d", version, k.MinDecryptionVersion)
+	}
+	return k.version(version)
+}
+
+func (v *keyVersion) privateKey() (crypto.Signer, error) {
+	if private, err := x509.ParsePKCS8PrivateKey(v.Secret); err != nil {
+		return nil, err
+	} else if signer, ok := private.(crypto.Signer); !ok {
+		return nil, errUnsupportedOperation
+	} else {
+		return signer, nil
+	}
+}
+
+// hmacKey derives the key used for HMACs from the version's secret, so the
+// HMAC key is distinct from the key used for encryption or signing.
+func (v *keyVersion) hmacKey() []byte {
+	mac := hmac.New(sha256.New, v.Secret)
+	mac.Write([]byte("hmac"))
+	return mac.Sum(nil)
+}
+
+func (k *key) encrypt(version *keyVersion, plaintext []byte, context []byte) ([]byte, error) {
+	switch k.Type {
+	case proto.KEY_TYPE_AES256:
+		if block, err := aes.NewCipher(version.Secret); err != nil {
+			return nil, err
+		} else if aead, err := cipher.NewGCM(block); err != nil {
+			return nil, err
+		} else {
+			nonce := make([]byte, aead.NonceSize())
+			if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+				return nil, err
+			}
+			return aead.Seal(nonce, nonce, plaintext, context), nil
+		}
+	case proto.KEY_TYPE_RSA_2048, proto.KEY_TYPE_RSA_4096:
+		if private, err := version.privateKey(); err != nil {
+			return nil, err
+		} else {
+			return rsa.EncryptOAEP(sha256.New(), rand.Reader, private.Public().(*rsa.PublicKey), plaintext, context)
+		}
+	default:
+		return nil, errUnsupportedOperation
+	}
+}
+
+func (k *key) decrypt(version *keyVersion, ciphertext []byte, context []byte) ([]byte, error) {
+	switch k.Type {
+	case proto.KEY_TYPE_AES256:
+		if block, err := aes.NewCipher(version.Secret); err != nil {
+			return nil, err
+		} else if aead, err := cipher.NewGCM(block); err != nil {
+			return nil, err
+		} else if len(ciphertext) < aead.NonceSize() {
+			return nil, hub.NewError(hub.CodeInvalidArgument, "invalid ciphertext")
+		} else {
+			return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], context)
+		}
+	case proto.KEY_TYPE_RSA_2048, proto.KEY_TYPE_RSA_4096:
+		if private, err := version.privateKey(); err != nil {
+			return nil, err
+		} else {
+			return rsa.DecryptOAEP(sha256.New(), rand.Reader, private.(*rsa.PrivateKey), ciphertext, context)
+		}
+	default:
+		return nil, errUnsupportedOperation
+	}
+}
+
+func (k *key) sign(version *keyVersion, input []byte, algorithm proto.HashAlgorithm) ([]byte, error) {
+	if k.Type == proto.KEY_TYPE_AES256 {
+		return nil, errUnsupportedOperation
+	} else if private, err := version.privateKey(); err != nil {
+		return nil, err
+	} else if k.Type == proto.KEY_TYPE_ED25519 {
+		return private.Sign(rand.Reader, input, crypto.Hash(0))
+	} else if h, err := newHash(algorithm); err != nil {
+		return nil, err
+	} else {
+		digest := h.New()
+		digest.Write(input)
+
+		if k.Type == proto.KEY_TYPE_ECDSA_P256 {
+			return private.Sign(rand.Reader, digest.Sum(nil), h)
+		}
+		return private.Sign(rand.Reader, digest.Sum(nil), &rsa.PSSOptions{Hash: h})
+	}
+}
+
+func (k *key) verify(version *keyVersion, input []byte, signature []byte, algorithm proto.HashAlgorithm) (bool, error) {
+	if k.Type == proto.KEY_TYPE_AES256 {
+		return false, errUnsupportedOperation
+	} else if public, err := x509.ParsePKIXPublicKey(version.PublicKey); err != nil {
+		return false, err
+	} else if k.Type == proto.KEY_TYPE_ED25519 {
+		return ed25519.Verify(public.(ed25519.PublicKey), input, signature), nil
+	} else if h, err := newHash(algorithm); err != nil {
+		return false, err
+	} else {
+		digest := h.New()
+		digest.Write(input)
+
+		if k.Type == proto.KEY_TYPE_ECDSA_P256 {
+			return ecdsa.VerifyASN1(public.(*ecdsa.PublicKey), digest.Sum(nil), signature), nil
+		}
+		return rsa.VerifyPSS(public.(*rsa.PublicKey), h, digest.Sum(nil), signature, nil) == nil, nil
+	}
+}
+
+func (k *key) hmac(version *keyVersion, input []byte, algorithm proto.HashAlgorithm) ([]byte, error) {
+	if h, err := newHash(algorithm); err != nil {
+		return nil, err
+	} else {
+		mac := hmac.New(func() hash.Hash { return h.New() }, version.hmacKey())
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	}
+}
+
+func (p *userProtocol) onEncrypt(req *hub.Request, encryptRequest proto.EncryptRequest) (*proto.EncryptResponse, error) {
+	if plaintext, err := decodeBase64("plaintext", encryptRequest.Plaintext); err != nil {
+		return nil, err
+	} else if context, err := decodeBase64("context", encryptRequest.Context); err != nil {
+		return nil, err
+	} else if k, err := loadKey(encryptRequest.Key); err != nil {
+		return nil, err
+	} else if version, err := k.encryptionVersion(encryptRequest.KeyVersion); err != nil {
+		return nil, err
+	} else if ciphertext, err := k.encrypt(version, plaintext, context); err != nil {
+		return nil, err
+	} else {
+		return &proto.EncryptResponse{
+			Ciphertext: encodeVersioned(version.Version, ciphertext),
+			KeyVersion: version.Version,
+		}, nil
+	}
+}
+
+func (p *userProtocol) onDecrypt(req *hub.Request, decryptRequest proto.DecryptRequest) (*proto.DecryptResponse, error) {
+	if context, err := decodeBase64("context", decryptRequest.Context); err != nil {
+		return nil, err
+	} else if versionNumber, ciphertext, err := decodeVersioned(decryptRequest.Ciphertext); err != nil {
+		return nil, err
+	} else if k, err := loadKey(decryptRequest.Key); err != nil {
+		return nil, err
+	} else if version, err := k.decryptionVersion(versionNumber); err != nil {
+		return nil, err
+	} else if plaintext, err := k.decrypt(version, ciphertext, context); err != nil {
+		return nil, err
+	} else {
+		return &proto.DecryptResponse{
+			Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+		}, nil
+	}
+}
+
+func (p *userProtocol) onRewrap(req *hub.Request, rewrapRequest proto.RewrapRequest) (*proto.RewrapResponse, error) {
+	if context, err := decodeBase64("context", rewrapRequest.Context); err != nil {
+		return nil, err
+	} else if versionNumber, ciphertext, err := decodeVersioned(rewrapRequest.Ciphertext); err != nil {
+		return nil, err
+	} else if k, err := loadKey(rewrapRequest.Key); err != nil {
+		return nil, err
+	} else if version, err := k.decryptionVersion(versionNumber); err != nil {
+		return nil, err
+	} else if plaintext, err := k.decrypt(version, ciphertext, context); err != nil {
+		return nil, err
+	} else if latest, err := k.encryptionVersion(rewrapRequest.KeyVersion); err != nil {
+		return nil, err
+	} else if ciphertext, err := k.encrypt(latest, plaintext, context); err != nil {
+		return nil, err
+	} else {
+		return &proto.RewrapResponse{
+			Ciphertext: encodeVersioned(latest.Version, ciphertext),
+			KeyVersion: latest.Version,
+		}, nil
+	}
+}
+
+func (p *userProtocol) onSign(req *hub.Request, signRequest proto.SignRequest) (*proto.SignResponse, error) {
+	if input, err := decodeBase64("input", signRequest.Input); err != nil {
+		return nil, err
+	} else if k, err := loadKey(signRequest.Key); err != nil {
+		return nil, err
+	} else if version, err := k.encryptionVersion(signRequest.KeyVersion); err != nil {
+		return nil, err
+	} else if signature, err := k.sign(version, input, signRequest.HashAlgorithm); err != nil {
+		return nil, err
+	} else {
+		return &proto.SignResponse{
+			Signature:  encodeVersioned(version.Version, signature),
+			KeyVersion: version.Version,
+		}, nil
+	}
+}
+
+func (p *userProtocol) onVerify(req *hub.Request, verifyRequest proto.VerifyRequest) (*proto.VerifyResponse, error) {
+	if input, err := decodeBase64("input", verifyRequest.Input); err != nil {
+		return nil, err
+	} else if k, err := loadKey(verifyRequest.Key); err != nil {
+		return nil, err
+	} else if verifyRequest.HMAC != "" {
+		if versionNumber, expected, err := decodeVersioned(verifyRequest.HMAC); err != nil {
+			return nil, err
+		} else if version, err := k.decryptionVersion(versionNumber); err != nil {
+			return nil, err
+		} else if actual, err := k.hmac(version, input, verifyRequest.HashAlgorithm); err != nil {
+			return nil, err
+		} else {
+			return &proto.VerifyResponse{
+				Valid: hmac.Equal(expected, actual),
+			}, nil
+		}
+	} else if versionNumber, signature, err := decodeVersioned(verifyRequest.Signature); err != nil {
+		return nil, err
+	} else if version, err := k.decryptionVersion(versionNumber); err != nil {
+		return nil, err
+	} else if valid, err := k.verify(version, input, signature, verifyRequest.HashAlgorithm); err != nil {
+		return nil, err
+	} else {
+		return &proto.VerifyResponse{
+			Valid: valid,
+		}, nil
+	}
+}
+
+func (p *userProtocol) onHMAC(req *hub.Request, hmacRequest proto.HMACRequest) (*proto.HMACResponse, error) {
+	if input, err := decodeBase64("input", hmacRequest.Input); err != nil {
+		return nil, err
+	} else if k, err := loadKey(hmacRequest.Key); err != nil {
+		return nil, err
+	} else if version, err := k.encryptionVersion(hmacRequest.KeyVersion); err != nil {
+		return nil, err
+	} else if mac, err := k.hmac(version, input, hmacRequest.HashAlgorithm); err != nil {
+		return nil, err
+	} else {
+		return &proto.HMACResponse{
+			HMAC:       encodeVersioned(version.Version, mac),
+			KeyVersion: version.Version,
+		}, nil
+	}
+}
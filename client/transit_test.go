@@ -0,0 +1,137 @@
+package client
+
+import (
+	"encoding/base64"
+	"testing"
+
+	proto "github.com/grexie/vault/protocol"
+)
+
+func TestDecodeVersioned(t *testing.T) {
+	tests := []struct {
+		value   string
+		version int
+		fail    bool
+	}{
+		{encodeVersioned(1, []byte("a")), 1, false},
+		{encodeVersioned(12, []byte("a")), 12, false},
+		{"vault:v0:YQ==", 0, true},
+		{"vault:v1", 0, true},
+		{"vault:vx:YQ==", 0, true},
+		{"vault:v1:not base64", 0, true},
+		{"YQ==", 0, true},
+	}
+
+	for _, test := range tests {
+		if version, value, err := decodeVersioned(test.value); test.fail {
+			if err == nil {
+				t.Errorf("decodeVersioned(%q) = %v, want an error", test.value, version)
+			}
+		} else if err != nil {
+			t.Errorf("decodeVersioned(%q): %v", test.value, err)
+		} else if version != test.version || string(value) != "a" {
+			t.Errorf("decodeVersioned(%q) = %v, %q", test.value, version, value)
+		}
+	}
+}
+
+func TestTransitVersions(t *testing.T) {
+	useMemoryStorage(t)
+	p := &userProtocol{}
+
+	if _, err := createKey(&proto.CreateKeyRequest{Name: "transit", Type: proto.KEY_TYPE_AES256}); err != nil {
+		t.Fatal(err)
+	}
+	plaintext := base64.StdEncoding.EncodeToString([]byte("plaintext"))
+
+	encrypt := func(keyVersion int) (*proto.EncryptResponse, error) {
+		return p.onEncrypt(nil, proto.EncryptRequest{Key: "transit", Plaintext: plaintext, KeyVersion: keyVersion})
+	}
+	decrypt := func(ciphertext string) error {
+		if res, err := p.onDecrypt(nil, proto.DecryptRequest{Key: "transit", Ciphertext: ciphertext}); err != nil {
+			return err
+		} else if res.Plaintext != plaintext {
+			t.Errorf("decrypted %q", res.Plaintext)
+		}
+		return nil
+	}
+
+	v1, err := encrypt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.onRotateKey(nil, proto.RotateKeyRequest{Key: "transit"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v3, err := encrypt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		op   func() (int, error)
+		want int
+		fail bool
+	}{
+		{"encrypt with the first version", func() (int, error) {
+			return v1.KeyVersion, nil
+		}, 1, false},
+		{"encrypt with the latest version", func() (int, error) {
+			return v3.KeyVersion, nil
+		}, 3, false},
+		{"encrypt with an older version", func() (int, error) {
+			res, err := encrypt(2)
+			if err != nil {
+				return 0, err
+			}
+			return res.KeyVersion, decrypt(res.Ciphertext)
+		}, 2, false},
+		{"encrypt with a missing version", func() (int, error) {
+			_, err := encrypt(4)
+			return 0, err
+		}, 0, true},
+		{"decrypt the first version", func() (int, error) {
+			return 1, decrypt(v1.Ciphertext)
+		}, 1, false},
+		{"rewrap to the latest version", func() (int, error) {
+			res, err := p.onRewrap(nil, proto.RewrapRequest{Key: "transit", Ciphertext: v1.Ciphertext})
+			if err != nil {
+				return 0, err
+			}
+			return res.KeyVersion, decrypt(res.Ciphertext)
+		}, 3, false},
+		{"raise the minimum decryption version", func() (int, error) {
+			minDecryptionVersion := 2
+			res, err := p.onSetKeyConfig(nil, proto.SetKeyConfigRequest{Key: "transit", MinDecryptionVersion: &minDecryptionVersion})
+			if err != nil {
+				return 0, err
+			}
+			return res.Key.MinDecryptionVersion, nil
+		}, 2, false},
+		{"decrypt below the minimum decryption version", func() (int, error) {
+			return 0, decrypt(v1.Ciphertext)
+		}, 0, true},
+		{"encrypt below the minimum decryption version", func() (int, error) {
+			_, err := encrypt(1)
+			return 0, err
+		}, 0, true},
+		{"decrypt the latest version", func() (int, error) {
+			return 3, decrypt(v3.Ciphertext)
+		}, 3, false},
+	}
+
+	for _, test := range tests {
+		if version, err := test.op(); test.fail {
+			if err == nil {
+				t.Errorf("%v: succeeded", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if version != test.want {
+			t.Errorf("%v: got version %v, want %v", test.name, version, test.want)
+		}
+	}
+}
@@ -2,9 +2,54 @@ package client
 
 import (
 	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
 )
 
-func startUserProtocol(hub *hub.Hub) error {
+type userProtocol struct {
+	hub      *hub.Hub
+	identity *proto.PeerIdentity
+}
+
+func startUserProtocol(h *hub.Hub, identity *proto.PeerIdentity) error {
+	if identity == nil {
+		identity = &proto.PeerIdentity{}
+	}
+
+	p := &userProtocol{
+		hub:      h,
+		identity: identity,
+	}
+
+	h.Intercept(p.checkSealed)
+	h.Intercept(p.authorize)
+
+	hub.HandleTyped(h, "init", p.onInit)
+	hub.HandleTyped(h, "unseal", p.onUnseal)
+	hub.HandleTyped(h, "seal", p.onSeal)
+	hub.HandleTyped(h, "seal-status", p.onSealStatus)
+
+	hub.HandleTyped(h, "create-key", p.onCreateKey)
+	hub.HandleTyped(h, "rotate-key", p.onRotateKey)
+	hub.HandleTyped(h, "set-key-config", p.onSetKeyConfig)
+	hub.HandleTyped(h, "trim-key", p.onTrimKey)
+	hub.HandleTyped(h, "delete-key", p.onDeleteKey)
+	hub.HandleTyped(h, "export-key", p.onExportKey)
+	hub.HandleTyped(h, "encrypt", p.onEncrypt)
+	hub.HandleTyped(h, "decrypt", p.onDecrypt)
+	hub.HandleTyped(h, "rewrap", p.onRewrap)
+	hub.HandleTyped(h, "sign", p.onSign)
+	hub.HandleTyped(h, "verify", p.onVerify)
+	hub.HandleTyped(h, "hmac", p.onHMAC)
+	hub.HandleTyped(h, "kv-put", p.onKVPut)
+	hub.HandleTyped(h, "kv-get", p.onKVGet)
+	hub.HandleTyped(h, "kv-delete", p.onKVDelete)
+	hub.HandleTyped(h, "kv-undelete", p.onKVUndelete)
+	hub.HandleTyped(h, "kv-destroy", p.onKVDestroy)
+	hub.HandleTyped(h, "kv-metadata", p.onKVMetadata)
+	hub.HandleTyped(h, "policy-put", p.onPolicyPut)
+	hub.HandleTyped(h, "policy-get", p.onPolicyGet)
+	hub.HandleTyped(h, "policy-list", p.onPolicyList)
+	hub.HandleTyped(h, "policy-delete", p.onPolicyDelete)
 
 	return nil
 }
@@ -0,0 +1,200 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// Message types passed to Writer.WriteMessage. They have the values of the
+// websocket frame opcodes.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+)
+
+// SubprotocolPrefix prefixes the codec names offered as websocket
+// subprotocols, e.g. "vault.cbor".
+const SubprotocolPrefix = "vault."
+
+// Codec encodes the messages of a hub and their payloads. Every codec honours
+// the json struct tags of the payload types, so the same types serve all of
+// them.
+type Codec interface {
+	Name() string
+	// MessageType is TextMessage for textual codecs and BinaryMessage for
+	// binary ones.
+	MessageType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// RawMessage is a payload encoded with the codec of the hub it was received
+// on. It is embedded as is when the envelope is encoded, so it must not be
+// sent on a hub with another codec. An encoded null decodes to an empty
+// RawMessage, as not every codec omits empty payloads.
+type RawMessage []byte
+
+func (m RawMessage) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	return m, nil
+}
+
+func (m *RawMessage) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*m = nil
+		return nil
+	}
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+func (m RawMessage) MarshalCBOR() ([]byte, error) {
+	if m == nil {
+		return []byte{0xf6}, nil
+	}
+	return m, nil
+}
+
+func (m *RawMessage) UnmarshalCBOR(data []byte) error {
+	if len(data) == 1 && data[0] == 0xf6 {
+		*m = nil
+		return nil
+	}
+	*m = append((*m)[0:0], data...)
+	return nil
+}
+
+func (m RawMessage) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if m == nil {
+		return enc.EncodeNil()
+	}
+	return enc.Encode(msgpack.RawMessage(m))
+}
+
+func (m *RawMessage) DecodeMsgpack(dec *msgpack.Decoder) error {
+	var raw msgpack.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	} else if len(raw) == 1 && raw[0] == msgpcode.Nil {
+		*m = nil
+		return nil
+	}
+	*m = RawMessage(raw)
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) MessageType() int                           { return TextMessage }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() *cborCodec {
+	enc, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return &cborCodec{enc, dec}
+}
+
+func (c *cborCodec) Name() string                               { return "cbor" }
+func (c *cborCodec) MessageType() int                           { return BinaryMessage }
+func (c *cborCodec) Marshal(v interface{}) ([]byte, error)      { return c.enc.Marshal(v) }
+func (c *cborCodec) Unmarshal(data []byte, v interface{}) error { return c.dec.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string     { return "msgpack" }
+func (msgpackCodec) MessageType() int { return BinaryMessage }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+var (
+	JSON        Codec = jsonCodec{}
+	CBOR        Codec = newCBORCodec()
+	MessagePack Codec = msgpackCodec{}
+)
+
+// codecs lists the supported codecs, most preferred first.
+var codecs = []Codec{CBOR, MessagePack, JSON}
+
+// Codecs returns the names of the supported codecs, most preferred first.
+func Codecs() []string {
+	names := []string{}
+	for _, codec := range codecs {
+		names = append(names, codec.Name())
+	}
+	return names
+}
+
+func LookupCodec(name string) (Codec, error) {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec \"%v\", available codecs: %v", name, strings.Join(Codecs(), ", "))
+}
+
+// NegotiateCodec returns the first of the offered codec names that is
+// supported, or JSON if there is none.
+func NegotiateCodec(offered []string) Codec {
+	for _, name := range offered {
+		if codec, err := LookupCodec(name); err == nil {
+			return codec
+		}
+	}
+	return JSON
+}
+
+// Subprotocols returns the websocket subprotocols offering the named codecs.
+func Subprotocols(names []string) []string {
+	subprotocols := []string{}
+	for _, name := range names {
+		subprotocols = append(subprotocols, SubprotocolPrefix+name)
+	}
+	return subprotocols
+}
+
+// SubprotocolCodec returns the codec of a negotiated websocket subprotocol.
+// Connections without a subprotocol, such as those of browsers that offer
+// none, use JSON.
+func SubprotocolCodec(subprotocol string) Codec {
+	if subprotocol == "" {
+		return JSON
+	}
+	return NegotiateCodec([]string{strings.TrimPrefix(subprotocol, SubprotocolPrefix)})
+}
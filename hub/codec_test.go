@@ -0,0 +1,121 @@
+package hub
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type codecPayload struct {
+	Name      string            `json:"name"`
+	Count     int               `json:"count"`
+	Enabled   bool              `json:"enabled,omitempty"`
+	Data      []byte            `json:"data"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Next      *codecPayload     `json:"next,omitempty"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	method := "method"
+	txID := uint32(7)
+	payloads := []struct {
+		name    string
+		payload *codecPayload
+	}{
+		{"nil", nil},
+		{"empty", &codecPayload{}},
+		{"full", &codecPayload{
+			Name:      "name",
+			Count:     -3,
+			Enabled:   true,
+			Data:      []byte{0, 1, 2, 255},
+			Labels:    map[string]string{"env": "prod"},
+			CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+			Next:      &codecPayload{Name: "next", Data: []byte{}},
+		}},
+	}
+
+	for _, codec := range codecs {
+		for _, test := range payloads {
+			t.Run(codec.Name()+"/"+test.name, func(t *testing.T) {
+				var raw RawMessage
+				if test.payload != nil {
+					var err error
+					if raw, err = codec.Marshal(test.payload); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				data, err := codec.Marshal(&message{
+					Method:      &method,
+					RequestTxID: &txID,
+					Error:       Errorf(CodeNotFound, "not found").WithDetails(map[string]interface{}{"key": "value"}),
+					Payload:     raw,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var msg message
+				if err := codec.Unmarshal(data, &msg); err != nil {
+					t.Fatal(err)
+				} else if msg.Method == nil || *msg.Method != method || msg.RequestTxID == nil || *msg.RequestTxID != txID {
+					t.Fatalf("decoded envelope %+v", msg)
+				} else if msg.ResponseTxID != nil || msg.Cancel {
+					t.Fatalf("decoded unset fields of envelope %+v", msg)
+				} else if msg.Error == nil || msg.Error.Code != CodeNotFound || msg.Error.Details["key"] != "value" {
+					t.Fatalf("decoded error %+v", msg.Error)
+				}
+
+				if test.payload == nil {
+					if len(msg.Payload) != 0 {
+						t.Fatalf("decoded payload %x, want none", msg.Payload)
+					}
+					return
+				}
+
+				var payload codecPayload
+				if err := codec.Unmarshal(msg.Payload, &payload); err != nil {
+					t.Fatal(err)
+				}
+				want := *test.payload
+				if want.Data == nil {
+					want.Data = payload.Data
+				}
+				if !payload.CreatedAt.Equal(want.CreatedAt) {
+					t.Fatalf("decoded time %v, want %v", payload.CreatedAt, want.CreatedAt)
+				}
+				payload.CreatedAt = want.CreatedAt
+				if want.Next != nil && payload.Next != nil {
+					payload.Next.CreatedAt = want.Next.CreatedAt
+				}
+				if !reflect.DeepEqual(payload, want) {
+					t.Fatalf("decoded %+v, want %+v", payload, want)
+				}
+			})
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		offered     []string
+		subprotocol string
+		want        Codec
+	}{
+		{[]string{"msgpack", "cbor"}, "vault.msgpack", MessagePack},
+		{[]string{"unknown", "cbor"}, "vault.cbor", CBOR},
+		{[]string{"unknown"}, "vault.unknown", JSON},
+		{nil, "", JSON},
+	}
+
+	for _, test := range tests {
+		if codec := NegotiateCodec(test.offered); codec != test.want {
+			t.Errorf("NegotiateCodec(%v) = %v, want %v", test.offered, codec.Name(), test.want.Name())
+		}
+		if codec := SubprotocolCodec(test.subprotocol); codec != test.want {
+			t.Errorf("SubprotocolCodec(%q) = %v, want %v", test.subprotocol, codec.Name(), test.want.Name())
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Code classifies an error sent over the wire, so that the receiving side
+// can tell failures apart without matching on messages.
+type Code string
+
+const (
+	CodeUnknown            Code = "unknown"
+	CodeInvalidArgument    Code = "invalid-argument"
+	CodeNotFound           Code = "not-found"
+	CodeAlreadyExists      Code = "already-exists"
+	CodePermissionDenied   Code = "permission-denied"
+	CodeUnauthenticated    Code = "unauthenticated"
+	CodeFailedPrecondition Code = "failed-precondition"
+	CodeSealed             Code = "sealed"
+	CodeUnimplemented      Code = "unimplemented"
+	CodeUnavailable        Code = "unavailable"
+	CodeResourceExhausted  Code = "resource-exhausted"
+	CodeDeadlineExceeded   Code = "deadline-exceeded"
+	CodeCanceled           Code = "canceled"
+)
+
+// Error is an error with a code. Handlers return it to choose the code sent
+// to the caller, and callers receive it in place of the remote error.
+// errors.Is reports whether two errors have the same code, so the received
+// error can be compared with the sentinels below.
+type Error struct {
+	Code    Code                   `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+var (
+	ErrInvalidArgument    = NewError(CodeInvalidArgument, "invalid argument")
+	ErrNotFound           = NewError(CodeNotFound, "not found")
+	ErrAlreadyExists      = NewError(CodeAlreadyExists, "already exists")
+	ErrPermissionDenied   = NewError(CodePermissionDenied, "permission denied")
+	ErrUnauthenticated    = NewError(CodeUnauthenticated, "unauthenticated")
+	ErrFailedPrecondition = NewError(CodeFailedPrecondition, "failed precondition")
+	ErrSealed             = NewError(CodeSealed, "sealed")
+	ErrUnimplemented      = NewError(CodeUnimplemented, "unimplemented")
+	ErrUnavailable        = NewError(CodeUnavailable, "unavailable")
+)
+
+func NewError(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func Errorf(code Code, format string, args ...interface{}) *Error {
+	return NewError(code, fmt.Sprintf(format, args...))
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	if t, ok := target.(*Error); ok {
+		return t.Code == e.Code
+	}
+	return false
+}
+
+// WithDetails returns a copy of e carrying details.
+func (e *Error) WithDetails(details map[string]interface{}) *Error {
+	return &Error{Code: e.Code, Message: e.Message, Details: details}
+}
+
+// UnmarshalJSON also accepts a bare string, as sent by peers predating error
+// codes.
+func (e *Error) UnmarshalJSON(bytes []byte) error {
+	var message string
+	if err := json.Unmarshal(bytes, &message); err == nil {
+		*e = Error{Code: CodeUnknown, Message: message}
+		return nil
+	}
+
+	type plain Error
+	var v plain
+	if err := json.Unmarshal(bytes, &v); err != nil {
+		return err
+	}
+	*e = Error(v)
+	if e.Code == "" {
+		e.Code = CodeUnknown
+	}
+	return nil
+}
+
+// toError converts err to the error sent over the wire. The message is that
+// of err, so context added by wrapping an *Error is kept.
+func toError(err error) *Error {
+	var e *Error
+
+	if errors.As(err, &e) {
+		return &Error{Code: e.Code, Message: err.Error(), Details: e.Details}
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		return NewError(CodeDeadlineExceeded, err.Error())
+	} else if errors.Is(err, context.Canceled) {
+		return NewError(CodeCanceled, err.Error())
+	} else if errors.Is(err, ErrClosed) {
+		return NewError(CodeUnavailable, err.Error())
+	} else {
+		return NewError(CodeUnknown, err.Error())
+	}
+}
@@ -1,117 +1,292 @@
 package hub
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrClosed is returned by requests that are pending when the hub is closed,
+// and by requests made after it is closed. Errors passed to Close wrap it.
+var ErrClosed = errors.New("hub closed")
+
 type Hub struct {
 	sync.Mutex
 	ID                string
 	writer            *threadSafeWriter
+	codec             Codec
 	handlers          map[string][]*handler
+	interceptors      []*handler
 	requests          map[uint32]*ClientRequest
+	responses         map[uint32]*responseWriter
 	nextTransactionId uint32
+	ctx               context.Context
+	cancel            context.CancelFunc
+	err               error
 }
 
 type handler struct {
 	Handler func(ResponseWriter, *Request) error
 }
 
+// Writer sends encoded messages, as TextMessage or BinaryMessage depending on
+// the codec. A websocket.Conn is a Writer.
 type Writer interface {
-	WriteJSON(interface{}) error
+	WriteMessage(messageType int, data []byte) error
 }
 
 type Transaction struct {
 	ID uint32
 }
 
+// Request is a request sent or received by the hub. Payload is kept encoded
+// so that handlers decode it into the type they expect, see HandleTyped.
 type Request struct {
 	Hub     *Hub
 	Method  string
 	TxID    uint32
-	Payload interface{}
+	Payload RawMessage
+	ctx     context.Context
+}
+
+// Context returns the context of an incoming request. It is done when the
+// deadline set by the caller passes, when the handlers return or when the
+// hub is closed.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
 }
 
 type ClientRequest struct {
 	Request
-	responseHandler func(interface{}, error)
+	responseHandler func(RawMessage, error)
+	stream          *Stream
+}
+
+// fail ends the request with err, without waiting for a response.
+func (r *ClientRequest) fail(err error) {
+	if r.stream != nil {
+		r.stream.end(nil, err)
+	} else {
+		go r.responseHandler(nil, err)
+	}
 }
 
 type ResponseWriter interface {
 	Write(interface{}) error
 }
 
+// message is the envelope of requests, responses and control messages.
+// Timeout is the time in milliseconds the caller is still waiting for a
+// response; it is relative so that it does not depend on the clocks of both
+// ends agreeing.
+//
+// A streamed response is a sequence of responses with More set, ended by a
+// response without it. Window is the number of frames the caller is ready to
+// buffer; the caller grants more with a control message carrying Credit once
+// it has consumed them, or stops the stream with Cancel. A request without a
+// window is not flow controlled.
 type message struct {
-	Method       *string     `json:"method,omitempty"`
-	RequestTxID  *uint32     `json:"itx,omitempty"`
-	ResponseTxID *uint32     `json:"otx,omitempty"`
-	Error        *string     `json:"error,omitempty"`
-	Payload      interface{} `json:"payload,omitempty"`
+	Method       *string    `json:"method,omitempty"`
+	RequestTxID  *uint32    `json:"itx,omitempty"`
+	ResponseTxID *uint32    `json:"otx,omitempty"`
+	ControlTxID  *uint32    `json:"ctl,omitempty"`
+	Timeout      *int64     `json:"timeout,omitempty"`
+	Window       *uint32    `json:"window,omitempty"`
+	Credit       uint32     `json:"credit,omitempty"`
+	Cancel       bool       `json:"cancel,omitempty"`
+	More         bool       `json:"more,omitempty"`
+	Error        *Error     `json:"error,omitempty"`
+	Payload      RawMessage `json:"payload,omitempty"`
 }
 
+func (h *Hub) encodePayload(payload interface{}) (RawMessage, error) {
+	if payload == nil {
+		return nil, nil
+	} else {
+		return h.codec.Marshal(payload)
+	}
+}
+
+func (h *Hub) write(msg message) error {
+	if bytes, err := h.codec.Marshal(&msg); err != nil {
+		return err
+	} else {
+		return h.writer.WriteMessage(h.codec.MessageType(), bytes)
+	}
+}
+
+// NewHub returns a hub encoding its messages as JSON.
 func NewHub(writer Writer) *Hub {
+	return NewHubWithCodec(writer, JSON)
+}
+
+// NewHubWithCodec returns a hub encoding its messages with codec, which both
+// ends of the connection have agreed on.
+func NewHubWithCodec(writer Writer, codec Codec) *Hub {
 	w := &threadSafeWriter{writer, sync.Mutex{}}
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Hub{
 		sync.Mutex{},
 		uuid.NewString(),
 		w,
+		codec,
 		map[string][]*handler{},
+		[]*handler{},
 		map[uint32]*ClientRequest{},
+		map[uint32]*responseWriter{},
 		0,
+		ctx,
+		cancel,
+		nil,
 	}
 }
 
-func (h *Hub) Request(method string, payload interface{}, handler func(interface{}, error)) error {
-	txID := h.nextTransactionId
-	h.nextTransactionId++
+// Close fails every pending request with an error wrapping ErrClosed and
+// cancels the contexts of the incoming requests still being handled. err is
+// the reason the connection closed, and may be nil.
+func (h *Hub) Close(err error) {
+	h.Lock()
+	if h.err != nil {
+		h.Unlock()
+		return
+	}
+
+	if err == nil {
+		h.err = ErrClosed
+	} else {
+		h.err = fmt.Errorf("%w: %v", ErrClosed, err)
+	}
+
+	requests := h.requests
+	h.requests = map[uint32]*ClientRequest{}
+	h.Unlock()
+
+	h.cancel()
+	for _, request := range requests {
+		request.fail(h.err)
+	}
+}
+
+func (h *Hub) Request(method string, payload interface{}, handler func(RawMessage, error)) error {
+	_, err := h.request(context.Background(), method, payload, &ClientRequest{responseHandler: handler})
+	return err
+}
+
+// request registers request to receive the response and sends it, with the
+// deadline of ctx, if any, as its timeout.
+func (h *Hub) request(ctx context.Context, method string, payload interface{}, request *ClientRequest) (uint32, error) {
+	encoded, err := h.encodePayload(payload)
+	if err != nil {
+		return 0, err
+	}
 
 	msg := message{
-		Method:      &method,
-		RequestTxID: &txID,
-		Payload:     payload,
+		Method:  &method,
+		Payload: encoded,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline).Milliseconds()
+		if timeout <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+		msg.Timeout = &timeout
+	}
+
+	if request.stream != nil {
+		msg.Window = &request.stream.window
 	}
 
 	h.Lock()
-	h.requests[txID] = &ClientRequest{
-		Request: Request{
-			Hub:     h,
-			Method:  method,
-			TxID:    txID,
-			Payload: payload,
-		},
-		responseHandler: handler,
+	if h.err != nil {
+		h.Unlock()
+		return 0, h.err
+	}
+
+	txID := h.nextTransactionId
+	h.nextTransactionId++
+	msg.RequestTxID = &txID
+
+	request.Request = Request{
+		Hub:     h,
+		Method:  method,
+		TxID:    txID,
+		Payload: encoded,
+		ctx:     ctx,
 	}
+	h.requests[txID] = request
 	h.Unlock()
 
-	return h.writer.WriteJSON(msg)
+	if err := h.write(msg); err != nil {
+		h.forgetRequest(txID)
+		return 0, err
+	}
+	return txID, nil
+}
+
+// forgetRequest forgets a pending request, so that a late response to it is
+// ignored.
+func (h *Hub) forgetRequest(txID uint32) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.requests, txID)
+}
+
+// cancelRequest forgets a pending request and asks the remote end to stop
+// handling it.
+func (h *Hub) cancelRequest(txID uint32) {
+	h.forgetRequest(txID)
+	h.write(message{
+		ControlTxID: &txID,
+		Cancel:      true,
+	})
 }
 
 func (h *Hub) RequestWithoutResponse(method string, payload interface{}) error {
-	return h.Request(method, payload, func(_ interface{}, _ error) {})
+	return h.Request(method, payload, func(_ RawMessage, _ error) {})
 }
 
 type response struct {
-	response interface{}
+	response RawMessage
 	err      error
 }
 
-func (h *Hub) RequestSync(method string, payload interface{}) (interface{}, error) {
-	ch := make(chan response)
-	defer close(ch)
-	h.Request(method, payload, func(res interface{}, err error) {
+// RequestContext sends a request and waits for its response. It returns the
+// error of ctx if ctx is done first, and an error wrapping ErrClosed if the
+// hub is closed first.
+func (h *Hub) RequestContext(ctx context.Context, method string, payload interface{}) (RawMessage, error) {
+	ch := make(chan response, 1)
+
+	txID, err := h.request(ctx, method, payload, &ClientRequest{responseHandler: func(res RawMessage, err error) {
 		ch <- response{
 			response: res,
 			err:      err,
 		}
-	})
-	res := <-ch
-	return res.response, res.err
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		return res.response, res.err
+	case <-ctx.Done():
+		h.cancelRequest(txID)
+		return nil, ctx.Err()
+	}
+}
+
+func (h *Hub) RequestSync(method string, payload interface{}) (RawMessage, error) {
+	return h.RequestContext(context.Background(), method, payload)
 }
 
 func (h *Hub) Handle(method string, handlerFn func(ResponseWriter, *Request) error) func() {
@@ -145,30 +320,92 @@ func (h *Hub) Handle(method string, handlerFn func(ResponseWriter, *Request) err
 	}
 }
 
+// Intercept registers a handler that runs before the handlers of every
+// incoming request. An interceptor returning an error fails the request
+// without running the remaining interceptors or handlers.
+func (h *Hub) Intercept(handlerFn func(ResponseWriter, *Request) error) func() {
+	h.Lock()
+	defer h.Unlock()
+
+	handlerPtr := &handler{
+		Handler: handlerFn,
+	}
+
+	h.interceptors = append(h.interceptors, handlerPtr)
+
+	return func() {
+		h.Lock()
+		defer h.Unlock()
+
+		for i, _handler := range h.interceptors {
+			if _handler == handlerPtr {
+				h.interceptors = append(h.interceptors[:i], h.interceptors[i+1:]...)
+			}
+		}
+	}
+}
+
 func (h *Hub) ProcessMessage(bytes []byte) error {
 	h.Lock()
 	defer h.Unlock()
 
 	msg := &message{}
-	if err := json.Unmarshal(bytes, msg); err != nil {
+	if err := h.codec.Unmarshal(bytes, msg); err != nil {
 		return err
 	} else if msg.RequestTxID != nil && msg.ResponseTxID != nil {
 		return errors.New("protocol error")
+	} else if msg.ControlTxID != nil {
+		if responseWriter, ok := h.responses[*msg.ControlTxID]; ok {
+			responseWriter.control(msg)
+		}
+		return nil
 	} else if msg.RequestTxID != nil {
 		if msg.Method == nil {
 			return errors.New("protocol error")
 		} else if handlers, exists := h.handlers[*msg.Method]; !exists {
-			return fmt.Errorf("handler does not exist for method \"%v\"", *msg.Method)
+			request := &Request{Hub: h, Method: *msg.Method, TxID: *msg.RequestTxID}
+			// written without the lock held, so that a slow writer does not
+			// hold up the messages of other requests
+			go h.newResponseWriter(request).writeError(Errorf(CodeUnimplemented, "handler does not exist for method \"%v\"", *msg.Method))
+			return nil
 		} else {
+			var ctx context.Context
+			var cancel context.CancelFunc
+			if msg.Timeout != nil {
+				ctx, cancel = context.WithTimeout(h.ctx, time.Duration(*msg.Timeout)*time.Millisecond)
+			} else {
+				ctx, cancel = context.WithCancel(h.ctx)
+			}
+
 			request := &Request{
 				Hub:     h,
 				Method:  *msg.Method,
 				TxID:    *msg.RequestTxID,
 				Payload: msg.Payload,
+				ctx:     ctx,
 			}
 			responseWriter := h.newResponseWriter(request)
+			responseWriter.cancel = cancel
+			if msg.Window != nil {
+				responseWriter.credit = int64(*msg.Window)
+			}
+			h.responses[request.TxID] = responseWriter
+
+			chain := append(append([]*handler{}, h.interceptors...), handlers...)
 			go func() {
-				for _, handler := range handlers {
+				defer func() {
+					h.Lock()
+					delete(h.responses, request.TxID)
+					h.Unlock()
+					cancel()
+				}()
+
+				for _, handler := range chain {
+					if err := ctx.Err(); err != nil {
+						responseWriter.writeError(err)
+						return
+					}
+
 					if err := handler.Handler(responseWriter, request); err != nil {
 						responseWriter.writeError(err)
 						return
@@ -185,12 +422,29 @@ func (h *Hub) ProcessMessage(bytes []byte) error {
 		if request, ok := h.requests[*msg.ResponseTxID]; ok {
 			var err error
 			if msg.Error != nil {
-				err = errors.New(*msg.Error)
+				err = msg.Error
+			}
+
+			if request.stream != nil && msg.More {
+				if !request.stream.push(msg.Payload) {
+					delete(h.requests, *msg.ResponseTxID)
+					request.stream.end(nil, errors.New("stream window exceeded"))
+					go h.write(message{
+						ControlTxID: msg.ResponseTxID,
+						Cancel:      true,
+					})
+				}
+				return nil
 			}
+
 			delete(h.requests, *msg.ResponseTxID)
-			go func() {
-				request.responseHandler(msg.Payload, err)
-			}()
+			if request.stream != nil {
+				request.stream.end(msg.Payload, err)
+			} else {
+				go func() {
+					request.responseHandler(msg.Payload, err)
+				}()
+			}
 		}
 		return nil
 	} else {
@@ -199,14 +453,85 @@ func (h *Hub) ProcessMessage(bytes []byte) error {
 }
 
 func (h *Hub) newResponseWriter(request *Request) *responseWriter {
-	return &responseWriter{sync.Mutex{}, request, h, false}
+	return &responseWriter{
+		request: request,
+		hub:     h,
+		credit:  -1,
+		signal:  make(chan struct{}, 1),
+		cancel:  func() {},
+	}
 }
 
+// responseWriter writes the response of an incoming request. credit is the
+// number of frames a stream may still send, or -1 when it is not flow
+// controlled; signal is notified whenever the caller grants more. credit has
+// a lock of its own, as the writer is locked while writing and grants are
+// received with the hub locked.
 type responseWriter struct {
 	sync.Mutex
-	request *Request
-	hub     *Hub
-	written bool
+	request     *Request
+	hub         *Hub
+	written     bool
+	creditMutex sync.Mutex
+	credit      int64
+	signal      chan struct{}
+	cancel      context.CancelFunc
+}
+
+func (w *responseWriter) control(msg *message) {
+	if msg.Cancel {
+		w.cancel()
+		return
+	}
+
+	w.creditMutex.Lock()
+	if w.credit >= 0 {
+		w.credit += int64(msg.Credit)
+	}
+	w.creditMutex.Unlock()
+
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Send writes one frame of a streamed response, waiting for the caller to
+// grant credit if it has as many frames buffered as it asked for.
+func (w *responseWriter) Send(frame interface{}) error {
+	payload, err := w.hub.encodePayload(frame)
+	if err != nil {
+		return err
+	}
+
+	for {
+		w.creditMutex.Lock()
+		granted := w.credit != 0
+		if w.credit > 0 {
+			w.credit--
+		}
+		w.creditMutex.Unlock()
+
+		if granted {
+			w.Lock()
+			defer w.Unlock()
+
+			if w.written {
+				return errors.New("response already sent")
+			}
+			return w.hub.write(message{
+				ResponseTxID: &w.request.TxID,
+				More:         true,
+				Payload:      payload,
+			})
+		}
+
+		select {
+		case <-w.signal:
+		case <-w.request.Context().Done():
+			return w.request.Context().Err()
+		}
+	}
 }
 
 func (w *responseWriter) Write(response interface{}) error {
@@ -216,14 +541,19 @@ func (w *responseWriter) Write(response interface{}) error {
 	if w.written {
 		return errors.New("response already sent")
 	}
+
+	payload, err := w.hub.encodePayload(response)
+	if err != nil {
+		return err
+	}
 	w.written = true
 
 	msg := message{
 		ResponseTxID: &w.request.TxID,
-		Payload:      response,
+		Payload:      payload,
 	}
 
-	return w.hub.writer.WriteJSON(msg)
+	return w.hub.write(msg)
 }
 
 func (w *responseWriter) writeError(err error) {
@@ -235,14 +565,12 @@ func (w *responseWriter) writeError(err error) {
 	}
 	w.written = true
 
-	errString := err.Error()
-
 	msg := message{
 		ResponseTxID: &w.request.TxID,
-		Error:        &errString,
+		Error:        toError(err),
 	}
 
-	w.hub.writer.WriteJSON(msg)
+	w.hub.write(msg)
 }
 
 type threadSafeWriter struct {
@@ -250,9 +578,9 @@ type threadSafeWriter struct {
 	sync.Mutex
 }
 
-func (t *threadSafeWriter) WriteJSON(v interface{}) error {
+func (t *threadSafeWriter) WriteMessage(messageType int, data []byte) error {
 	t.Lock()
 	defer t.Unlock()
 
-	return t.Writer.WriteJSON(v)
+	return t.Writer.WriteMessage(messageType, data)
 }
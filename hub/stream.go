@@ -0,0 +1,222 @@
+package hub
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// DefaultStreamWindow is the number of frames a stream buffers before the
+// sending end waits for them to be received.
+const DefaultStreamWindow = 16
+
+// StreamWriter is the ResponseWriter passed to stream handlers. Send writes a
+// frame and blocks while the caller has as many frames buffered as its
+// window allows. The stream ends when the handler returns.
+type StreamWriter interface {
+	ResponseWriter
+	Send(interface{}) error
+}
+
+// Stream receives the frames of a streamed response. credit is the number of
+// frames the remote end may still send, granted back in halves of the window
+// as they are received, so that frames never outnumber the buffer. The end
+// of the stream is kept apart from the frames so that recording it never
+// blocks.
+type Stream struct {
+	sync.Mutex
+	hub      *Hub
+	method   string
+	txID     uint32
+	ctx      context.Context
+	window   uint32
+	frames   chan RawMessage
+	credit   uint32
+	consumed uint32
+	ended    chan struct{}
+	final    RawMessage
+	err      error
+	done     bool
+}
+
+// push buffers a frame, returning false if the remote end sent more frames
+// than it was granted credit for.
+func (s *Stream) push(payload RawMessage) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.credit == 0 {
+		return false
+	}
+	s.credit--
+	s.frames <- payload
+	return true
+}
+
+// end records the final frame, if any, and the end of the stream. Only the
+// first call has an effect.
+func (s *Stream) end(payload RawMessage, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	select {
+	case <-s.ended:
+		return
+	default:
+	}
+
+	if err == nil && len(payload) > 0 {
+		s.final = payload
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	s.err = err
+	close(s.ended)
+}
+
+// Stream sends a request to a stream handler. Frames are received with Recv
+// until it returns io.EOF. Cancelling ctx or calling Close stops the remote
+// handler.
+func (h *Hub) Stream(ctx context.Context, method string, payload interface{}) (*Stream, error) {
+	s := &Stream{
+		hub:    h,
+		method: method,
+		ctx:    ctx,
+		window: DefaultStreamWindow,
+		frames: make(chan RawMessage, DefaultStreamWindow),
+		credit: DefaultStreamWindow,
+		ended:  make(chan struct{}),
+	}
+
+	if txID, err := h.request(ctx, method, payload, &ClientRequest{stream: s}); err != nil {
+		return nil, err
+	} else {
+		s.txID = txID
+		return s, nil
+	}
+}
+
+// received grants credit back to the remote end once half of the window has
+// been received. The grant is written with the stream unlocked, as push locks
+// it while the hub is locked.
+func (s *Stream) received(payload RawMessage) (RawMessage, error) {
+	s.Lock()
+	grant := uint32(0)
+	if s.consumed++; s.consumed >= s.window/2 {
+		grant = s.consumed
+		s.credit += grant
+		s.consumed = 0
+	}
+	s.Unlock()
+
+	if grant > 0 {
+		s.hub.write(message{
+			ControlTxID: &s.txID,
+			Credit:      grant,
+		})
+	}
+	return payload, nil
+}
+
+// finish returns the final frame, if any, and then the error the stream
+// ended with.
+func (s *Stream) finish() (RawMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.final != nil {
+		payload := s.final
+		s.final = nil
+		return payload, nil
+	}
+	s.done = true
+	return nil, s.err
+}
+
+// Recv returns the next frame of the stream, io.EOF once the stream has
+// ended, or the error the stream failed with.
+func (s *Stream) Recv() (RawMessage, error) {
+	s.Lock()
+	done := s.done
+	s.Unlock()
+	if done {
+		return nil, io.EOF
+	}
+
+	// frames buffered before the end are received before it
+	select {
+	case payload := <-s.frames:
+		return s.received(payload)
+	default:
+	}
+
+	select {
+	case payload := <-s.frames:
+		return s.received(payload)
+	case <-s.ended:
+		select {
+		case payload := <-s.frames:
+			return s.received(payload)
+		default:
+			return s.finish()
+		}
+	case <-s.ctx.Done():
+		s.Close()
+		return nil, s.ctx.Err()
+	}
+}
+
+// Close stops the stream, cancelling the remote handler if it has not ended
+// yet.
+func (s *Stream) Close() {
+	s.Lock()
+	if s.done {
+		s.Unlock()
+		return
+	}
+	s.done = true
+	s.Unlock()
+
+	s.hub.Lock()
+	_, pending := s.hub.requests[s.txID]
+	s.hub.Unlock()
+
+	if pending {
+		s.hub.cancelRequest(s.txID)
+	}
+}
+
+// HandleStream registers a handler for a streamed response. Frames written
+// with Send are delivered to the caller in order, and the stream ends when
+// handlerFn returns.
+func (h *Hub) HandleStream(method string, handlerFn func(StreamWriter, *Request) error) func() {
+	return h.Handle(method, func(res ResponseWriter, req *Request) error {
+		return handlerFn(res.(StreamWriter), req)
+	})
+}
+
+// HandleStreamTyped registers a stream handler that receives the payload of
+// a request decoded into Req and sends frames of type Res.
+func HandleStreamTyped[Req any, Res any](h *Hub, method string, handlerFn func(*Request, Req, func(Res) error) error) func() {
+	return h.HandleStream(method, func(res StreamWriter, req *Request) error {
+		if payload, err := decodePayload[Req](h.codec, method, req.Payload); err != nil {
+			return err
+		} else {
+			return handlerFn(req, payload, func(frame Res) error {
+				return res.Send(frame)
+			})
+		}
+	})
+}
+
+// Receive returns the next frame of s decoded into T, or io.EOF once the
+// stream has ended.
+func Receive[T any](s *Stream) (T, error) {
+	if frame, err := s.Recv(); err != nil {
+		var v T
+		return v, err
+	} else {
+		return decodePayload[T](s.hub.codec, s.method, frame)
+	}
+}
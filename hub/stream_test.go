@@ -0,0 +1,247 @@
+package hub
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// pipeWriter delivers the messages written to it to a hub, in order and on
+// a goroutine of its own as a connection would.
+type pipeWriter struct {
+	messages chan []byte
+}
+
+func newPipe() (*pipeWriter, *pipeWriter) {
+	return &pipeWriter{messages: make(chan []byte, 1024)}, &pipeWriter{messages: make(chan []byte, 1024)}
+}
+
+func (w *pipeWriter) WriteMessage(messageType int, data []byte) error {
+	w.messages <- append([]byte{}, data...)
+	return nil
+}
+
+func (w *pipeWriter) deliver(t *testing.T, h *Hub) {
+	go func() {
+		for data := range w.messages {
+			if err := h.ProcessMessage(data); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+}
+
+// connectedHubs returns two hubs whose messages are delivered to each other.
+func connectedHubs(t *testing.T) (*Hub, *Hub) {
+	toB, toA := newPipe()
+	a := NewHub(toB)
+	b := NewHub(toA)
+	toB.deliver(t, b)
+	toA.deliver(t, a)
+	return a, b
+}
+
+func TestStream(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames int
+		final  bool
+	}{
+		{"empty", 0, false},
+		{"within window", DefaultStreamWindow / 2, false},
+		{"beyond window", DefaultStreamWindow*4 + 3, false},
+		{"final payload", DefaultStreamWindow * 2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := connectedHubs(t)
+			b.HandleStream("count", func(res StreamWriter, req *Request) error {
+				n, err := decodePayload[int](b.codec, req.Method, req.Payload)
+				if err != nil {
+					return err
+				}
+				for i := 0; i < n; i++ {
+					if err := res.Send(i); err != nil {
+						return err
+					}
+				}
+				if test.final {
+					return res.Write(n)
+				}
+				return nil
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			s, err := a.Stream(ctx, "count", test.frames)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := test.frames
+			if test.final {
+				want++
+			}
+			for i := 0; i < want; i++ {
+				if frame, err := Receive[int](s); err != nil {
+					t.Fatalf("frame %v: %v", i, err)
+				} else if frame != i {
+					t.Fatalf("frame %v: got %v", i, frame)
+				}
+			}
+			if _, err := s.Recv(); err != io.EOF {
+				t.Fatalf("got %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+// TestStreamWindowExceeded sends more frames than the window allows to a
+// stream, as a remote end ignoring credit would, and checks that the hub
+// keeps processing messages and the stream fails.
+func TestStreamWindowExceeded(t *testing.T) {
+	discard, _ := newPipe()
+	h := NewHub(discard)
+
+	s, err := h.Stream(context.Background(), "flood", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processed := make(chan error, 1)
+	go func() {
+		for i := 0; i < DefaultStreamWindow+4; i++ {
+			payload, _ := h.encodePayload(i)
+			if data, err := h.codec.Marshal(&message{ResponseTxID: &s.txID, More: true, Payload: payload}); err != nil {
+				processed <- err
+				return
+			} else if err := h.ProcessMessage(data); err != nil {
+				processed <- err
+				return
+			}
+		}
+		payload, _ := h.encodePayload("final")
+		data, _ := h.codec.Marshal(&message{ResponseTxID: &s.txID, Payload: payload})
+		processed <- h.ProcessMessage(data)
+	}()
+
+	select {
+	case err := <-processed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub blocked processing frames beyond the window")
+	}
+
+	for i := 0; i < DefaultStreamWindow; i++ {
+		if _, err := s.Recv(); err != nil {
+			t.Fatalf("frame %v: %v", i, err)
+		}
+	}
+	if _, err := s.Recv(); err == nil || err == io.EOF {
+		t.Fatalf("got %v, want the window to be exceeded", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked")
+	}
+}
+
+// blockingWriter blocks every write once blocked is closed, as a writer
+// waiting for a congested connection would, until released is closed.
+type blockingWriter struct {
+	blocked  chan struct{}
+	released chan struct{}
+	writing  chan struct{}
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{blocked: make(chan struct{}), released: make(chan struct{}), writing: make(chan struct{}, 1024)}
+}
+
+func (w *blockingWriter) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-w.blocked:
+		w.writing <- struct{}{}
+		<-w.released
+	default:
+	}
+	return nil
+}
+
+// TestBlockedWriter checks that the hub keeps processing messages while a
+// write it started on receiving one is blocked.
+func TestBlockedWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		block func(t *testing.T, h *Hub, s *Stream) []byte
+	}{
+		{"unknown method", func(t *testing.T, h *Hub, s *Stream) []byte {
+			method := "unknown"
+			txID := uint32(1000)
+			data, _ := h.codec.Marshal(&message{Method: &method, RequestTxID: &txID})
+			return data
+		}},
+		{"stream credit", func(t *testing.T, h *Hub, s *Stream) []byte {
+			for i := 0; i < DefaultStreamWindow/2; i++ {
+				data, _ := h.codec.Marshal(&message{ResponseTxID: &s.txID, More: true, Payload: RawMessage("1")})
+				if err := h.ProcessMessage(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			go func() {
+				// the last frame of the half window grants credit
+				for i := 0; i < DefaultStreamWindow/2; i++ {
+					s.Recv()
+				}
+			}()
+			return nil
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := newBlockingWriter()
+			defer close(w.released)
+			h := NewHub(w)
+			s, err := h.Stream(context.Background(), "stream", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			close(w.blocked)
+
+			if data := test.block(t, h, s); data != nil {
+				go h.ProcessMessage(data)
+			}
+			select {
+			case <-w.writing:
+			case <-time.After(5 * time.Second):
+				t.Fatal("nothing was written")
+			}
+
+			processed := make(chan error, 1)
+			go func() {
+				data, _ := h.codec.Marshal(&message{ResponseTxID: &s.txID, More: true, Payload: RawMessage("2")})
+				processed <- h.ProcessMessage(data)
+			}()
+			select {
+			case err := <-processed:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("hub blocked behind the write")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// ErrInvalidPayload is wrapped by the errors returned when a payload cannot
+// be decoded into the type a handler or caller expects.
+var ErrInvalidPayload = NewError(CodeInvalidArgument, "invalid payload")
+
+func decodePayload[T any](codec Codec, method string, payload RawMessage) (T, error) {
+	var v T
+	if len(payload) == 0 {
+		return v, nil
+	} else if err := codec.Unmarshal(payload, &v); err != nil {
+		return v, fmt.Errorf("%w for %v: %v", ErrInvalidPayload, method, err)
+	} else {
+		return v, nil
+	}
+}
+
+// Decode decodes the payload of req into T, for handlers that write their
+// response themselves rather than through HandleTyped.
+func Decode[T any](req *Request) (T, error) {
+	return decodePayload[T](req.Hub.codec, req.Method, req.Payload)
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	switch value := reflect.ValueOf(v); value.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return value.IsNil()
+	default:
+		return false
+	}
+}
+
+// HandleTyped registers a handler that receives the payload of a request
+// decoded into Req, and whose result is written as the response. A payload
+// that does not decode fails the request without calling handlerFn. A nil
+// result writes no response, leaving it to the other handlers of method.
+func HandleTyped[Req any, Res any](h *Hub, method string, handlerFn func(*Request, Req) (Res, error)) func() {
+	return h.Handle(method, func(res ResponseWriter, req *Request) error {
+		if payload, err := decodePayload[Req](h.codec, method, req.Payload); err != nil {
+			return err
+		} else if result, err := handlerFn(req, payload); err != nil {
+			return err
+		} else if isNil(result) {
+			return nil
+		} else {
+			return res.Write(result)
+		}
+	})
+}
+
+// Call sends a request and decodes its response into Res.
+func Call[Res any](h *Hub, method string, payload interface{}) (Res, error) {
+	return CallContext[Res](context.Background(), h, method, payload)
+}
+
+// CallContext sends a request and decodes its response into Res, giving up
+// when ctx is done.
+func CallContext[Res any](ctx context.Context, h *Hub, method string, payload interface{}) (Res, error) {
+	if res, err := h.RequestContext(ctx, method, payload); err != nil {
+		var v Res
+		return v, err
+	} else {
+		return decodePayload[Res](h.codec, method, res)
+	}
+}
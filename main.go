@@ -6,8 +6,14 @@ import (
 	"os"
 	"strings"
 
+	_ "github.com/grexie/vault/broker/memory"
+	_ "github.com/grexie/vault/broker/redis"
 	"github.com/grexie/vault/client"
+	_ "github.com/grexie/vault/seal/file"
+	_ "github.com/grexie/vault/seal/pkcs11"
 	"github.com/grexie/vault/server"
+	_ "github.com/grexie/vault/storage/bolt"
+	_ "github.com/grexie/vault/storage/memory"
 )
 
 type command struct {
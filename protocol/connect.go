@@ -1,5 +1,7 @@
 package protocol
 
+import webrtc "github.com/pion/webrtc/v3"
+
 type ConnectType string
 
 const (
@@ -7,10 +9,70 @@ const (
 	CONNECT_TYPE_USER    ConnectType = "user"
 )
 
+type CredentialType string
+
+const (
+	CREDENTIAL_TYPE_TOKEN       CredentialType = "token"
+	CREDENTIAL_TYPE_ED25519     CredentialType = "ed25519"
+	CREDENTIAL_TYPE_CERTIFICATE CredentialType = "certificate"
+)
+
+// Credential authenticates a ConnectRequest. Token credentials carry a bearer
+// token. Ed25519 credentials carry a base64 encoded public key and the
+// signature of ChallengeMessage for the challenge returned by the
+// "challenge" method. Certificate credentials carry nothing, authenticating
+// with the client certificate the TLS connection was verified with.
+type Credential struct {
+	Type      CredentialType `json:"type"`
+	Token     string         `json:"token,omitempty"`
+	PublicKey string         `json:"publicKey,omitempty"`
+	Signature string         `json:"signature,omitempty"`
+}
+
+// ConnectRequest registers a connection with the broker. Services may
+// describe themselves with Labels. Users may restrict the services they are
+// announced to with Services, a list of service IDs or "key=value" label
+// selectors; an empty list asks for every service they are authorized for.
+// Codecs lists the codecs a user accepts on the data channels of its peers,
+// most preferred first; JSON is used if none is supported by the service.
+// Version is the PROTOCOL_VERSION of the connecting peer and Features its
+// capabilities; the server refuses peers whose version it does not speak.
+// A reconnecting service sends the ResumeToken of its previous connection
+// to resume its session.
 type ConnectRequest struct {
-	Type ConnectType `json:"type"`
+	Version     uint32            `json:"version,omitempty"`
+	Features    []Feature         `json:"features,omitempty"`
+	Type        ConnectType       `json:"type"`
+	Credential  *Credential       `json:"credential,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Services    []string          `json:"services,omitempty"`
+	Codecs      []string          `json:"codecs,omitempty"`
+	ResumeToken string            `json:"resumeToken,omitempty"`
 }
 
+// ConnectResponse carries the negotiated protocol version, the features of
+// the server and the STUN and TURN servers peers connect through. TURN
+// credentials are minted for the connection and expire.
+//
+// Services are given a ResumeToken, valid for a single reconnect within the
+// grace period of the server. Resumed is set when the connection took over
+// the session of the token sent, in which case Peers lists the peers still
+// alive; the peers of a session that was not resumed have been deleted.
 type ConnectResponse struct {
-	ICEServers []string `json:"iceServers"`
+	Version     uint32             `json:"version"`
+	Features    []Feature          `json:"features"`
+	ICEServers  []webrtc.ICEServer `json:"iceServers"`
+	ResumeToken string             `json:"resumeToken,omitempty"`
+	Resumed     bool               `json:"resumed,omitempty"`
+	Peers       []string           `json:"peers,omitempty"`
+}
+
+type ChallengeResponse struct {
+	Challenge string `json:"challenge"`
+}
+
+// ChallengeMessage returns the message signed to prove possession of a key
+// when connecting as connectType.
+func ChallengeMessage(challenge []byte, connectType ConnectType) []byte {
+	return append([]byte("vault-connect:"+string(connectType)+":"), challenge...)
 }
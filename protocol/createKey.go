@@ -1,4 +1,40 @@
 package protocol
 
+import "time"
+
+type KeyType string
+
+const (
+	KEY_TYPE_AES256     KeyType = "aes256-gcm96"
+	KEY_TYPE_ED25519    KeyType = "ed25519"
+	KEY_TYPE_ECDSA_P256 KeyType = "ecdsa-p256"
+	KEY_TYPE_RSA_2048   KeyType = "rsa-2048"
+	KEY_TYPE_RSA_4096   KeyType = "rsa-4096"
+)
+
 type CreateKeyRequest struct {
+	Name            string            `json:"name"`
+	Type            KeyType           `json:"type"`
+	Exportable      bool              `json:"exportable,omitempty"`
+	DeletionAllowed bool              `json:"deletionAllowed,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+type Key struct {
+	ID                   string            `json:"id"`
+	Name                 string            `json:"name"`
+	Type                 KeyType           `json:"type"`
+	LatestVersion        int               `json:"latestVersion"`
+	MinAvailableVersion  int               `json:"minAvailableVersion"`
+	MinDecryptionVersion int               `json:"minDecryptionVersion"`
+	MinEncryptionVersion int               `json:"minEncryptionVersion"`
+	DeletionAllowed      bool              `json:"deletionAllowed"`
+	Exportable           bool              `json:"exportable"`
+	PublicKeys           map[int]string    `json:"publicKeys,omitempty"`
+	Metadata             map[string]string `json:"metadata,omitempty"`
+	CreatedAt            time.Time         `json:"createdAt"`
+}
+
+type CreateKeyResponse struct {
+	Key
 }
@@ -0,0 +1,53 @@
+package protocol
+
+type RotateKeyRequest struct {
+	Key string `json:"key"`
+}
+
+type RotateKeyResponse struct {
+	Key
+}
+
+// SetKeyConfigRequest updates the policy of a key. Fields left unset keep
+// their current value. A MinEncryptionVersion of 0 always encrypts with the
+// latest version.
+type SetKeyConfigRequest struct {
+	Key                  string `json:"key"`
+	MinDecryptionVersion *int   `json:"minDecryptionVersion,omitempty"`
+	MinEncryptionVersion *int   `json:"minEncryptionVersion,omitempty"`
+	DeletionAllowed      *bool  `json:"deletionAllowed,omitempty"`
+	Exportable           *bool  `json:"exportable,omitempty"`
+}
+
+type SetKeyConfigResponse struct {
+	Key
+}
+
+// TrimKeyRequest permanently removes every version of a key below
+// MinAvailableVersion.
+type TrimKeyRequest struct {
+	Key                 string `json:"key"`
+	MinAvailableVersion int    `json:"minAvailableVersion"`
+}
+
+type TrimKeyResponse struct {
+	Key
+}
+
+type DeleteKeyRequest struct {
+	Key string `json:"key"`
+}
+
+// ExportKeyRequest exports the private material of an exportable key, either
+// every available version or only KeyVersion when it is set.
+type ExportKeyRequest struct {
+	Key        string `json:"key"`
+	KeyVersion int    `json:"keyVersion,omitempty"`
+}
+
+type ExportKeyResponse struct {
+	ID   string         `json:"id"`
+	Name string         `json:"name"`
+	Type KeyType        `json:"type"`
+	Keys map[int]string `json:"keys"`
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import "time"
+
+type KVVersionMetadata struct {
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"createdAt"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	Destroyed bool       `json:"destroyed"`
+}
+
+type KVMetadata struct {
+	Path           string                     `json:"path"`
+	CurrentVersion int                        `json:"currentVersion"`
+	OldestVersion  int                        `json:"oldestVersion"`
+	MaxVersions    int                        `json:"maxVersions"`
+	CasRequired    bool                       `json:"casRequired"`
+	CreatedAt      time.Time                  `json:"createdAt"`
+	UpdatedAt      time.Time                  `json:"updatedAt"`
+	Versions       map[int]*KVVersionMetadata `json:"versions"`
+}
+
+// KVPutRequest writes a new version of the secret at Path. When Cas is set
+// the write only succeeds if the current version equals Cas, with 0 meaning
+// the secret must not exist yet.
+type KVPutRequest struct {
+	Path string                 `json:"path"`
+	Data map[string]interface{} `json:"data"`
+	Cas  *int                   `json:"cas,omitempty"`
+}
+
+type KVPutResponse struct {
+	KVVersionMetadata
+}
+
+// KVGetRequest reads the secret at Path, at Version if it is set or the
+// current version otherwise. Data is omitted from the response if the
+// version has been deleted or destroyed.
+type KVGetRequest struct {
+	Path    string `json:"path"`
+	Version int    `json:"version,omitempty"`
+}
+
+type KVGetResponse struct {
+	Data     map[string]interface{} `json:"data"`
+	Metadata KVVersionMetadata      `json:"metadata"`
+}
+
+// KVDeleteRequest soft deletes Versions of the secret at Path, or the current
+// version if Versions is empty.
+type KVDeleteRequest struct {
+	Path     string `json:"path"`
+	Versions []int  `json:"versions,omitempty"`
+}
+
+type KVUndeleteRequest struct {
+	Path     string `json:"path"`
+	Versions []int  `json:"versions"`
+}
+
+// KVDestroyRequest permanently removes the data of Versions of the secret at
+// Path.
+type KVDestroyRequest struct {
+	Path     string `json:"path"`
+	Versions []int  `json:"versions"`
+}
+
+// KVMetadataRequest returns the metadata of the secret at Path, first
+// updating MaxVersions and CasRequired when they are set.
+type KVMetadataRequest struct {
+	Path        string `json:"path"`
+	MaxVersions *int   `json:"maxVersions,omitempty"`
+	CasRequired *bool  `json:"casRequired,omitempty"`
+}
+
+type KVMetadataResponse struct {
+	KVMetadata
+}
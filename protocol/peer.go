@@ -4,13 +4,30 @@ import (
 	webrtc "github.com/pion/webrtc/v3"
 )
 
+// PeerIdentity is the authenticated identity of the user a peer is created
+// for, as established by the broker.
+type PeerIdentity struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// CreatePeerRequest asks a service to create a peer for a user. Codecs are
+// the codecs the user accepts on the data channel of the peer, and
+// ICEServers the servers the peer gathers candidates from, with TURN
+// credentials minted for it, replacing those of ConnectResponse.
 type CreatePeerRequest struct {
-	ID string `json:"id"`
+	ID         string             `json:"id"`
+	User       *PeerIdentity      `json:"user,omitempty"`
+	Codecs     []string           `json:"codecs,omitempty"`
+	ICEServers []webrtc.ICEServer `json:"iceServers,omitempty"`
 }
 
+// CreatePeerResponse carries the offer of a service, and announces it to the
+// user with the ICE servers minted for the user's end of the peer.
 type CreatePeerResponse struct {
 	ID                 string                     `json:"id"`
 	SessionDescription *webrtc.SessionDescription `json:"sessionDescription"`
+	ICEServers         []webrtc.ICEServer         `json:"iceServers,omitempty"`
 }
 
 type DeletePeerRequest struct {
@@ -0,0 +1,48 @@
+package protocol
+
+type Capability string
+
+const (
+	CAPABILITY_READ   Capability = "read"
+	CAPABILITY_CREATE Capability = "create"
+	CAPABILITY_UPDATE Capability = "update"
+	CAPABILITY_DELETE Capability = "delete"
+	CAPABILITY_LIST   Capability = "list"
+	CAPABILITY_SUDO   Capability = "sudo"
+	CAPABILITY_DENY   Capability = "deny"
+)
+
+// PolicyRule grants Capabilities on the paths matching Path. A trailing "*"
+// matches any suffix, otherwise Path is matched as a path.Match pattern.
+type PolicyRule struct {
+	Path         string       `json:"path"`
+	Capabilities []Capability `json:"capabilities"`
+}
+
+// Policy grants its rules to the user identities named in Identities, where
+// "*" names every identity.
+type Policy struct {
+	Name       string       `json:"name"`
+	Identities []string     `json:"identities"`
+	Rules      []PolicyRule `json:"rules"`
+}
+
+type PolicyPutRequest struct {
+	Policy
+}
+
+type PolicyGetRequest struct {
+	Name string `json:"name"`
+}
+
+type PolicyGetResponse struct {
+	Policy
+}
+
+type PolicyListResponse struct {
+	Names []string `json:"names"`
+}
+
+type PolicyDeleteRequest struct {
+	Name string `json:"name"`
+}
@@ -0,0 +1,30 @@
+package protocol
+
+type InitRequest struct {
+	Shares    int `json:"shares"`
+	Threshold int `json:"threshold"`
+}
+
+// InitResponse carries the base64 encoded unseal key shares. They are only
+// ever returned once, by the request that initializes the vault.
+type InitResponse struct {
+	Shares []string `json:"shares"`
+}
+
+// UnsealRequest submits one base64 encoded unseal key share. Reset discards
+// the shares submitted so far instead.
+type UnsealRequest struct {
+	Share string `json:"share,omitempty"`
+	Reset bool   `json:"reset,omitempty"`
+}
+
+// SealStatusResponse reports the state of the vault. Type is the name of the
+// seal, "shamir" when the vault is only unsealed by key shares.
+type SealStatusResponse struct {
+	Type        string `json:"type"`
+	Initialized bool   `json:"initialized"`
+	Sealed      bool   `json:"sealed"`
+	Shares      int    `json:"shares"`
+	Threshold   int    `json:"threshold"`
+	Progress    int    `json:"progress"`
+}
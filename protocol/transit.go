@@ -0,0 +1,85 @@
+package protocol
+
+type HashAlgorithm string
+
+const (
+	HASH_ALGORITHM_SHA2_256 HashAlgorithm = "sha2-256"
+	HASH_ALGORITHM_SHA2_384 HashAlgorithm = "sha2-384"
+	HASH_ALGORITHM_SHA2_512 HashAlgorithm = "sha2-512"
+)
+
+// Plaintext, context and input fields are base64 encoded. Ciphertexts,
+// signatures and HMACs are prefixed with the version of the key that produced
+// them, as in "vault:v1:...". A KeyVersion of 0 selects the latest version.
+
+type EncryptRequest struct {
+	Key        string `json:"key"`
+	Plaintext  string `json:"plaintext"`
+	Context    string `json:"context,omitempty"`
+	KeyVersion int    `json:"keyVersion,omitempty"`
+}
+
+type EncryptResponse struct {
+	Ciphertext string `json:"ciphertext"`
+	KeyVersion int    `json:"keyVersion"`
+}
+
+type DecryptRequest struct {
+	Key        string `json:"key"`
+	Ciphertext string `json:"ciphertext"`
+	Context    string `json:"context,omitempty"`
+}
+
+type DecryptResponse struct {
+	Plaintext string `json:"plaintext"`
+}
+
+type RewrapRequest struct {
+	Key        string `json:"key"`
+	Ciphertext string `json:"ciphertext"`
+	Context    string `json:"context,omitempty"`
+	KeyVersion int    `json:"keyVersion,omitempty"`
+}
+
+type RewrapResponse struct {
+	Ciphertext string `json:"ciphertext"`
+	KeyVersion int    `json:"keyVersion"`
+}
+
+type SignRequest struct {
+	Key           string        `json:"key"`
+	Input         string        `json:"input"`
+	HashAlgorithm HashAlgorithm `json:"hashAlgorithm,omitempty"`
+	KeyVersion    int           `json:"keyVersion,omitempty"`
+}
+
+type SignResponse struct {
+	Signature  string `json:"signature"`
+	KeyVersion int    `json:"keyVersion"`
+}
+
+// VerifyRequest checks either a signature or, when HMAC is set, an HMAC
+// produced by the key.
+type VerifyRequest struct {
+	Key           string        `json:"key"`
+	Input         string        `json:"input"`
+	Signature     string        `json:"signature,omitempty"`
+	HMAC          string        `json:"hmac,omitempty"`
+	HashAlgorithm HashAlgorithm `json:"hashAlgorithm,omitempty"`
+}
+
+type VerifyResponse struct {
+	Valid bool `json:"valid"`
+}
+
+type HMACRequest struct {
+	Key           string        `json:"key"`
+	Input         string        `json:"input"`
+	HashAlgorithm HashAlgorithm `json:"hashAlgorithm,omitempty"`
+	KeyVersion    int           `json:"keyVersion,omitempty"`
+}
+
+type HMACResponse struct {
+	HMAC       string `json:"hmac"`
+	KeyVersion int    `json:"keyVersion"`
+}
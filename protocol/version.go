@@ -0,0 +1,48 @@
+package protocol
+
+// PROTOCOL_VERSION is the version of the wire protocol spoken by this build,
+// and MIN_PROTOCOL_VERSION the oldest version it still speaks. A connection
+// uses the lower of the versions of its two ends. Version 2 replaced the ICE
+// server urls of ConnectResponse with ICE servers carrying credentials.
+const (
+	PROTOCOL_VERSION     uint32 = 2
+	MIN_PROTOCOL_VERSION uint32 = 2
+)
+
+type Feature string
+
+const (
+	FEATURE_ERROR_CODES Feature = "error-codes"
+	FEATURE_DEADLINES   Feature = "deadlines"
+	FEATURE_STREAMING   Feature = "streaming"
+	FEATURE_CODECS      Feature = "codecs"
+	FEATURE_RESUME      Feature = "resume"
+)
+
+// Features lists the optional capabilities of this build.
+var Features = []Feature{
+	FEATURE_ERROR_CODES,
+	FEATURE_DEADLINES,
+	FEATURE_STREAMING,
+	FEATURE_CODECS,
+	FEATURE_RESUME,
+}
+
+// NegotiateVersion returns the version spoken with a peer speaking version,
+// and whether it is supported. Peers predating versioning send no version,
+// so they are never supported.
+func NegotiateVersion(version uint32) (uint32, bool) {
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	return version, version >= MIN_PROTOCOL_VERSION
+}
+
+func HasFeature(features []Feature, feature Feature) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
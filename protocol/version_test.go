@@ -0,0 +1,41 @@
+package protocol
+
+import "testing"
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		version uint32
+		want    uint32
+		ok      bool
+	}{
+		{0, 0, false},
+		{MIN_PROTOCOL_VERSION - 1, MIN_PROTOCOL_VERSION - 1, false},
+		{MIN_PROTOCOL_VERSION, MIN_PROTOCOL_VERSION, true},
+		{PROTOCOL_VERSION, PROTOCOL_VERSION, true},
+		{PROTOCOL_VERSION + 1, PROTOCOL_VERSION, true},
+	}
+
+	for _, test := range tests {
+		if version, ok := NegotiateVersion(test.version); version != test.want || ok != test.ok {
+			t.Errorf("NegotiateVersion(%v) = %v, %v, want %v, %v", test.version, version, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestHasFeature(t *testing.T) {
+	tests := []struct {
+		features []Feature
+		feature  Feature
+		want     bool
+	}{
+		{Features, FEATURE_RESUME, true},
+		{[]Feature{FEATURE_STREAMING}, FEATURE_RESUME, false},
+		{nil, FEATURE_RESUME, false},
+	}
+
+	for _, test := range tests {
+		if got := HasFeature(test.features, test.feature); got != test.want {
+			t.Errorf("HasFeature(%v, %v) = %v, want %v", test.features, test.feature, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package file
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"io"
+	"path"
+
+	"github.com/grexie/vault/seal"
+	"github.com/grexie/vault/storage"
+	"github.com/grexie/vault/storage/encrypted"
+)
+
+// FileSeal wraps the master key with an AES-256-GCM key read from a local
+// file. It stands in for a KMS or HSM and protects the vault no better than
+// the permissions of the key file.
+type FileSeal struct {
+	keyFile *string
+	aead    cipher.AEAD
+}
+
+func init() {
+	seal.Register("file", func() seal.Seal {
+		return &FileSeal{}
+	})
+}
+
+func (s *FileSeal) CreateFlags(flagSet *flag.FlagSet) error {
+	s.keyFile = flagSet.String("seal-key-file", path.Join(storage.DefaultDataDir(), "seal.key"), "file containing the base64 encoded seal key, generated if missing")
+	return nil
+}
+
+func (s *FileSeal) Initialize() error {
+	if key, err := encrypted.LoadMasterKey(*s.keyFile); err != nil {
+		return err
+	} else if block, err := aes.NewCipher(key); err != nil {
+		return err
+	} else if aead, err := cipher.NewGCM(block); err != nil {
+		return err
+	} else {
+		s.aead = aead
+		return nil
+	}
+}
+
+func (s *FileSeal) Wrap(key []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (s *FileSeal) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < s.aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	return s.aead.Open(nil, wrapped[:s.aead.NonceSize()], wrapped[s.aead.NonceSize():], nil)
+}
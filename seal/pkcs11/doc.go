@@ -0,0 +1,4 @@
+// Package pkcs11 provides a seal backed by an AES key held in a PKCS#11
+// module, such as an HSM or SoftHSM. It requires cgo; without it the package
+// registers nothing.
+package pkcs11
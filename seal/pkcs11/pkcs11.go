@@ -0,0 +1,167 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grexie/vault/seal"
+	p11 "github.com/miekg/pkcs11"
+)
+
+const nonceSize = 12
+const tagBits = 128
+
+// PKCS11Seal wraps the master key with AES-GCM using a non-extractable AES
+// key held by a PKCS#11 token. The key is generated on the token if no key
+// with the configured label exists.
+type PKCS11Seal struct {
+	sync.Mutex
+	module     *string
+	tokenLabel *string
+	pin        *string
+	keyLabel   *string
+	ctx        *p11.Ctx
+	session    p11.SessionHandle
+	key        p11.ObjectHandle
+}
+
+func init() {
+	seal.Register("pkcs11", func() seal.Seal {
+		return &PKCS11Seal{}
+	})
+}
+
+func (s *PKCS11Seal) CreateFlags(flagSet *flag.FlagSet) error {
+	s.module = flagSet.String("pkcs11-module", "", "path to the PKCS#11 module")
+	s.tokenLabel = flagSet.String("pkcs11-token", "", "label of the PKCS#11 token holding the seal key")
+	s.pin = flagSet.String("pkcs11-pin", "", "user PIN of the PKCS#11 token")
+	s.keyLabel = flagSet.String("pkcs11-key", "vault-seal", "label of the AES key used to wrap the master key")
+	return nil
+}
+
+func (s *PKCS11Seal) findSlot() (uint, error) {
+	if slots, err := s.ctx.GetSlotList(true); err != nil {
+		return 0, err
+	} else {
+		for _, slot := range slots {
+			if info, err := s.ctx.GetTokenInfo(slot); err != nil {
+				return 0, err
+			} else if info.Label == *s.tokenLabel {
+				return slot, nil
+			}
+		}
+		return 0, fmt.Errorf("pkcs11 token %q not found", *s.tokenLabel)
+	}
+}
+
+func (s *PKCS11Seal) findKey() (p11.ObjectHandle, error) {
+	template := []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_SECRET_KEY),
+		p11.NewAttribute(p11.CKA_LABEL, *s.keyLabel),
+	}
+
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, err
+	}
+	defer s.ctx.FindObjectsFinal(s.session)
+
+	if objects, _, err := s.ctx.FindObjects(s.session, 1); err != nil {
+		return 0, err
+	} else if len(objects) == 0 {
+		return s.generateKey()
+	} else {
+		return objects[0], nil
+	}
+}
+
+func (s *PKCS11Seal) generateKey() (p11.ObjectHandle, error) {
+	return s.ctx.GenerateKey(s.session, []*p11.Mechanism{p11.NewMechanism(p11.CKM_AES_KEY_GEN, nil)}, []*p11.Attribute{
+		p11.NewAttribute(p11.CKA_CLASS, p11.CKO_SECRET_KEY),
+		p11.NewAttribute(p11.CKA_KEY_TYPE, p11.CKK_AES),
+		p11.NewAttribute(p11.CKA_VALUE_LEN, 32),
+		p11.NewAttribute(p11.CKA_LABEL, *s.keyLabel),
+		p11.NewAttribute(p11.CKA_TOKEN, true),
+		p11.NewAttribute(p11.CKA_PRIVATE, true),
+		p11.NewAttribute(p11.CKA_SENSITIVE, true),
+		p11.NewAttribute(p11.CKA_EXTRACTABLE, false),
+		p11.NewAttribute(p11.CKA_ENCRYPT, true),
+		p11.NewAttribute(p11.CKA_DECRYPT, true),
+	})
+}
+
+func (s *PKCS11Seal) Initialize() error {
+	if *s.module == "" {
+		return errors.New("pkcs11-module is required")
+	}
+
+	s.ctx = p11.New(*s.module)
+	if s.ctx == nil {
+		return fmt.Errorf("unable to load pkcs11 module %v", *s.module)
+	} else if err := s.ctx.Initialize(); err != nil {
+		return err
+	} else if slot, err := s.findSlot(); err != nil {
+		return err
+	} else if session, err := s.ctx.OpenSession(slot, p11.CKF_SERIAL_SESSION|p11.CKF_RW_SESSION); err != nil {
+		return err
+	} else {
+		s.session = session
+	}
+
+	if err := s.ctx.Login(s.session, p11.CKU_USER, *s.pin); err != nil {
+		return err
+	} else if key, err := s.findKey(); err != nil {
+		return err
+	} else {
+		s.key = key
+		return nil
+	}
+}
+
+func (s *PKCS11Seal) Wrap(key []byte) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	params := p11.NewGCMParams(nonce, nil, tagBits)
+	defer params.Free()
+
+	if err := s.ctx.EncryptInit(s.session, []*p11.Mechanism{p11.NewMechanism(p11.CKM_AES_GCM, params)}, s.key); err != nil {
+		return nil, err
+	} else if ciphertext, err := s.ctx.Encrypt(s.session, key); err != nil {
+		return nil, err
+	} else {
+		if iv := params.IV(); len(iv) == nonceSize {
+			nonce = iv
+		}
+		return append(nonce, ciphertext...), nil
+	}
+}
+
+func (s *PKCS11Seal) Unwrap(wrapped []byte) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("wrapped key too short")
+	}
+
+	params := p11.NewGCMParams(wrapped[:nonceSize], nil, tagBits)
+	defer params.Free()
+
+	if err := s.ctx.DecryptInit(s.session, []*p11.Mechanism{p11.NewMechanism(p11.CKM_AES_GCM, params)}, s.key); err != nil {
+		return nil, err
+	} else {
+		return s.ctx.Decrypt(s.session, wrapped[nonceSize:])
+	}
+}
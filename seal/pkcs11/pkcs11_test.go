@@ -0,0 +1,116 @@
+//go:build cgo
+// +build cgo
+
+package pkcs11
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"testing"
+)
+
+// softHSMModules are the paths SoftHSM installs its module at, tried when
+// SOFTHSM2_MODULE is unset.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+func getenv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// newSoftHSMSeal returns a seal on a SoftHSM token. The test is skipped
+// unless SOFTHSM2_CONF is set and the token is initialized, e.g. with
+//
+//	softhsm2-util --init-token --free --label vault-test --pin 1234 --so-pin 1234
+//
+// SOFTHSM2_MODULE, PKCS11_TOKEN and PKCS11_PIN override the module path, the
+// token label and the PIN.
+func newSoftHSMSeal(t *testing.T) *PKCS11Seal {
+	t.Helper()
+
+	if os.Getenv("SOFTHSM2_CONF") == "" {
+		t.Skip("SOFTHSM2_CONF is not set")
+	}
+
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, path := range softHSMModules {
+		if module != "" {
+			break
+		} else if _, err := os.Stat(path); err == nil {
+			module = path
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM module not found, set SOFTHSM2_MODULE")
+	}
+
+	s := &PKCS11Seal{}
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := s.CreateFlags(flagSet); err != nil {
+		t.Fatal(err)
+	} else if err := flagSet.Parse([]string{
+		"-pkcs11-module", module,
+		"-pkcs11-token", getenv("PKCS11_TOKEN", "vault-test"),
+		"-pkcs11-pin", getenv("PKCS11_PIN", "1234"),
+		"-pkcs11-key", "vault-seal-test",
+	}); err != nil {
+		t.Fatal(err)
+	} else if err := s.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	s := newSoftHSMSeal(t)
+
+	tests := []struct {
+		name string
+		key  []byte
+	}{
+		{"master key", bytes.Repeat([]byte{0x42}, 32)},
+		{"short", []byte{1}},
+		{"empty", []byte{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wrapped, err := s.Wrap(test.key)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(test.key) > 0 && bytes.Contains(wrapped, test.key) {
+				t.Fatal("wrapped key contains the key")
+			}
+
+			if key, err := s.Unwrap(wrapped); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(key, test.key) {
+				t.Fatalf("unwrapped %x, want %x", key, test.key)
+			}
+
+			// the wrapped key is authenticated
+			wrapped[len(wrapped)-1] ^= 1
+			if _, err := s.Unwrap(wrapped); err == nil {
+				t.Fatal("unwrapped a tampered key")
+			}
+		})
+	}
+
+	if again, err := s.Wrap([]byte{1}); err != nil {
+		t.Fatal(err)
+	} else if wrapped, _ := s.Wrap([]byte{1}); bytes.Equal(again, wrapped) {
+		t.Error("wrapping reused a nonce")
+	}
+
+	if _, err := s.Unwrap([]byte{1, 2, 3}); err == nil {
+		t.Error("unwrapped a key shorter than the nonce")
+	}
+}
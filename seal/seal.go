@@ -0,0 +1,60 @@
+// Package seal defines how the master key of the vault is protected at rest
+// by an external key, so that the service can unseal itself on boot.
+package seal
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Seal wraps and unwraps the master key with a key it holds, such as a key
+// file or a key stored in a hardware security module.
+type Seal interface {
+	CreateFlags(flagSet *flag.FlagSet) error
+	Initialize() error
+	Wrap(key []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+var seals = map[string]func() Seal{}
+var sealsMutex = sync.Mutex{}
+
+// Register makes a seal available to Open under name. It is intended to be
+// called from the init function of the seal's package.
+func Register(name string, factory func() Seal) {
+	sealsMutex.Lock()
+	defer sealsMutex.Unlock()
+
+	if _, exists := seals[name]; exists {
+		panic(fmt.Sprintf("seal %q registered twice", name))
+	}
+	seals[name] = factory
+}
+
+// Seals returns the sorted names of the registered seals.
+func Seals() []string {
+	sealsMutex.Lock()
+	defer sealsMutex.Unlock()
+
+	names := []string{}
+	for name := range seals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open returns a new instance of the seal registered as name.
+func Open(name string) (Seal, error) {
+	sealsMutex.Lock()
+	factory, ok := seals[name]
+	sealsMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown seal %q, available seals: %v", name, strings.Join(Seals(), ", "))
+	}
+	return factory(), nil
+}
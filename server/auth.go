@@ -0,0 +1,280 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+var ErrUnauthenticated = hub.NewError(hub.CodeUnauthenticated, "unauthenticated")
+
+// Identity is the authenticated principal behind a connection, the tenant it
+// belongs to and the connection types it may register as. Labels are those
+// its services carry for routing: a service may declare a label only with
+// the value given here, or with any value where it is "*".
+type Identity struct {
+	Name   string              `json:"name"`
+	Tenant string              `json:"tenant,omitempty"`
+	Types  []proto.ConnectType `json:"types"`
+	Labels map[string]string   `json:"labels,omitempty"`
+}
+
+func (i *Identity) allows(connectType proto.ConnectType) bool {
+	for _, t := range i.Types {
+		if t == connectType {
+			return true
+		}
+	}
+	return false
+}
+
+// labels returns the labels of a service of the identity declaring
+// declared: those of the identity with a fixed value, along with the
+// declared ones it allows.
+func (i *Identity) labels(declared map[string]string) (map[string]string, error) {
+	labels := map[string]string{}
+	for key, value := range i.Labels {
+		if value != "*" {
+			labels[key] = value
+		}
+	}
+
+	for key, value := range declared {
+		if allowed, ok := i.Labels[key]; !ok || (allowed != "*" && allowed != value) {
+			return nil, hub.Errorf(hub.CodePermissionDenied, "label %v=%v is not allowed for %v", key, value, i.Name)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+type AuthenticationRequest struct {
+	ConnectRequest *proto.ConnectRequest
+	Challenge      []byte
+	HTTPRequest    *http.Request
+}
+
+// Authenticator validates the credential of a connect request. It returns a
+// nil identity and nil error when it does not handle the credential, so that
+// the next authenticator is consulted.
+type Authenticator interface {
+	Authenticate(req *AuthenticationRequest) (*Identity, error)
+}
+
+var authenticators = []Authenticator{}
+var authenticatorsMutex = sync.Mutex{}
+
+// RegisterAuthenticator adds an authenticator consulted for every connect
+// request, in the order of registration.
+func RegisterAuthenticator(authenticator Authenticator) {
+	authenticatorsMutex.Lock()
+	defer authenticatorsMutex.Unlock()
+
+	authenticators = append(authenticators, authenticator)
+}
+
+func authenticate(req *AuthenticationRequest) (*Identity, error) {
+	authenticatorsMutex.Lock()
+	registered := authenticators
+	authenticatorsMutex.Unlock()
+
+	for _, authenticator := range registered {
+		if identity, err := authenticator.Authenticate(req); err != nil {
+			return nil, err
+		} else if identity == nil {
+			continue
+		} else if !identity.allows(req.ConnectRequest.Type) {
+			return nil, hub.NewError(hub.CodePermissionDenied, "permission denied")
+		} else {
+			return identity, nil
+		}
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+func readJSONFile(filename string, v interface{}) error {
+	if bytes, err := os.ReadFile(filename); err != nil {
+		return err
+	} else {
+		return json.Unmarshal(bytes, v)
+	}
+}
+
+type tokenEntry struct {
+	Identity
+	Token string `json:"token"`
+}
+
+// TokenAuthenticator accepts bearer token credentials listed in a JSON file
+// of the form [{"token": "...", "name": "...", "types": ["service"]}].
+type TokenAuthenticator struct {
+	tokens []tokenEntry
+}
+
+func NewTokenAuthenticator(filename string) (*TokenAuthenticator, error) {
+	a := &TokenAuthenticator{}
+	if err := readJSONFile(filename, &a.tokens); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *TokenAuthenticator) Authenticate(req *AuthenticationRequest) (*Identity, error) {
+	credential := req.ConnectRequest.Credential
+	if credential == nil || credential.Type != proto.CREDENTIAL_TYPE_TOKEN {
+		return nil, nil
+	}
+
+	for _, entry := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(entry.Token), []byte(credential.Token)) == 1 {
+			identity := entry.Identity
+			return &identity, nil
+		}
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+type keyEntry struct {
+	Identity
+	PublicKey string `json:"publicKey"`
+}
+
+// Ed25519Authenticator accepts challenge signatures made by the base64
+// encoded public keys listed in a JSON file of the form
+// [{"publicKey": "...", "name": "...", "types": ["user"]}].
+type Ed25519Authenticator struct {
+	keys []keyEntry
+}
+
+func NewEd25519Authenticator(filename string) (*Ed25519Authenticator, error) {
+	a := &Ed25519Authenticator{}
+	if err := readJSONFile(filename, &a.keys); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Ed25519Authenticator) Authenticate(req *AuthenticationRequest) (*Identity, error) {
+	credential := req.ConnectRequest.Credential
+	if credential == nil || credential.Type != proto.CREDENTIAL_TYPE_ED25519 {
+		return nil, nil
+	} else if req.Challenge == nil {
+		return nil, hub.NewError(hub.CodeFailedPrecondition, "no challenge has been issued")
+	}
+
+	for _, entry := range a.keys {
+		if entry.PublicKey != credential.PublicKey {
+			continue
+		} else if publicKey, err := base64.StdEncoding.DecodeString(entry.PublicKey); err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid public key configured for " + entry.Name)
+		} else if signature, err := base64.StdEncoding.DecodeString(credential.Signature); err != nil {
+			return nil, ErrUnauthenticated
+		} else if !ed25519.Verify(publicKey, proto.ChallengeMessage(req.Challenge, req.ConnectRequest.Type), signature) {
+			return nil, ErrUnauthenticated
+		} else {
+			identity := entry.Identity
+			return &identity, nil
+		}
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+type certificateEntry struct {
+	Identity
+	CommonName string `json:"commonName"`
+}
+
+// CertificateAuthenticator accepts the client certificates verified against
+// -client-ca whose subject common name is listed in a JSON file of the form
+// [{"commonName": "...", "name": "...", "types": ["service"]}].
+type CertificateAuthenticator struct {
+	certificates []certificateEntry
+}
+
+func NewCertificateAuthenticator(filename string) (*CertificateAuthenticator, error) {
+	a := &CertificateAuthenticator{}
+	if err := readJSONFile(filename, &a.certificates); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *CertificateAuthenticator) Authenticate(req *AuthenticationRequest) (*Identity, error) {
+	credential := req.ConnectRequest.Credential
+	if credential == nil || credential.Type != proto.CREDENTIAL_TYPE_CERTIFICATE {
+		return nil, nil
+	}
+
+	state := req.HTTPRequest.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil, ErrUnauthenticated
+	}
+
+	commonName := state.PeerCertificates[0].Subject.CommonName
+	for _, entry := range a.certificates {
+		if entry.CommonName != "" && entry.CommonName == commonName {
+			identity := entry.Identity
+			return &identity, nil
+		}
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+// AnonymousAuthenticator accepts every connection. It exists for local
+// development and must be enabled explicitly.
+type AnonymousAuthenticator struct{}
+
+func (a *AnonymousAuthenticator) Authenticate(req *AuthenticationRequest) (*Identity, error) {
+	return &Identity{
+		Name:   "anonymous",
+		Types:  []proto.ConnectType{req.ConnectRequest.Type},
+		Labels: req.ConnectRequest.Labels,
+	}, nil
+}
+
+func loadAuthenticators() error {
+	if *authTokensPath != "" {
+		if a, err := NewTokenAuthenticator(*authTokensPath); err != nil {
+			return err
+		} else {
+			RegisterAuthenticator(a)
+		}
+	}
+
+	if *authKeysPath != "" {
+		if a, err := NewEd25519Authenticator(*authKeysPath); err != nil {
+			return err
+		} else {
+			RegisterAuthenticator(a)
+		}
+	}
+
+	if *authCertsPath != "" {
+		if *clientCA == "" {
+			return fmt.Errorf("-auth-certs requires -client-ca")
+		} else if a, err := NewCertificateAuthenticator(*authCertsPath); err != nil {
+			return err
+		} else {
+			RegisterAuthenticator(a)
+		}
+	}
+
+	if *allowAnonymous {
+		RegisterAuthenticator(&AnonymousAuthenticator{})
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	proto "github.com/grexie/vault/protocol"
+)
+
+func TestAuthenticators(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := []byte("challenge")
+	signature := ed25519.Sign(privateKey, proto.ChallengeMessage(challenge, proto.CONNECT_TYPE_SERVICE))
+
+	tokens := &TokenAuthenticator{tokens: []tokenEntry{
+		{Identity: Identity{Name: "token"}, Token: "secret"},
+	}}
+	keys := &Ed25519Authenticator{keys: []keyEntry{
+		{Identity: Identity{Name: "key"}, PublicKey: base64.StdEncoding.EncodeToString(publicKey)},
+	}}
+	certificates := &CertificateAuthenticator{certificates: []certificateEntry{
+		{Identity: Identity{Name: "certificate"}, CommonName: "svc.example.com"},
+	}}
+
+	verified := func(commonName string) *tls.ConnectionState {
+		certificate := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		return &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{certificate},
+			VerifiedChains:   [][]*x509.Certificate{{certificate}},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		credential    *proto.Credential
+		tls           *tls.ConnectionState
+		want          string
+		fail          bool
+	}{
+		{"token", tokens, &proto.Credential{Type: proto.CREDENTIAL_TYPE_TOKEN, Token: "secret"}, nil, "token", false},
+		{"wrong token", tokens, &proto.Credential{Type: proto.CREDENTIAL_TYPE_TOKEN, Token: "wrong"}, nil, "", true},
+		{"token ignores keys", tokens, &proto.Credential{Type: proto.CREDENTIAL_TYPE_ED25519}, nil, "", false},
+		{"key", keys, &proto.Credential{
+			Type:      proto.CREDENTIAL_TYPE_ED25519,
+			PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+			Signature: base64.StdEncoding.EncodeToString(signature),
+		}, nil, "key", false},
+		{"wrong signature", keys, &proto.Credential{
+			Type:      proto.CREDENTIAL_TYPE_ED25519,
+			PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+			Signature: base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize)),
+		}, nil, "", true},
+		{"certificate", certificates, &proto.Credential{Type: proto.CREDENTIAL_TYPE_CERTIFICATE}, verified("svc.example.com"), "certificate", false},
+		{"unknown certificate", certificates, &proto.Credential{Type: proto.CREDENTIAL_TYPE_CERTIFICATE}, verified("other.example.com"), "", true},
+		{"unverified certificate", certificates, &proto.Credential{Type: proto.CREDENTIAL_TYPE_CERTIFICATE}, &tls.ConnectionState{
+			PeerCertificates: verified("svc.example.com").PeerCertificates,
+		}, "", true},
+		{"no tls", certificates, &proto.Credential{Type: proto.CREDENTIAL_TYPE_CERTIFICATE}, nil, "", true},
+		{"certificate ignores tokens", certificates, &proto.Credential{Type: proto.CREDENTIAL_TYPE_TOKEN}, verified("svc.example.com"), "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := test.authenticator.Authenticate(&AuthenticationRequest{
+				ConnectRequest: &proto.ConnectRequest{Type: proto.CONNECT_TYPE_SERVICE, Credential: test.credential},
+				Challenge:      challenge,
+				HTTPRequest:    &http.Request{TLS: test.tls},
+			})
+
+			if test.fail {
+				if err == nil {
+					t.Fatalf("authenticated as %v", identity)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if test.want == "" && identity != nil {
+				t.Fatalf("authenticated as %v, want the credential to be ignored", identity.Name)
+			} else if test.want != "" && (identity == nil || identity.Name != test.want) {
+				t.Fatalf("authenticated as %v, want %v", identity, test.want)
+			}
+		})
+	}
+}
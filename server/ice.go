@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	proto "github.com/grexie/vault/protocol"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// ICEServerConfig is a STUN or TURN server handed to peers when they connect.
+// TURN servers either have a static Username and Credential, or a Secret
+// shared with the TURN server, from which time-limited credentials are
+// minted for every connection following the TURN REST API scheme.
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+}
+
+type ICEConfig struct {
+	Servers []ICEServerConfig `json:"servers"`
+}
+
+var iceConfig = &ICEConfig{Servers: []ICEServerConfig{}}
+
+func splitURLs(s string) []string {
+	urls := []string{}
+	for _, url := range strings.Split(s, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// loadICEConfig reads the servers of the -ice-servers file and appends those
+// given with -stun and -turn.
+func loadICEConfig() error {
+	config := &ICEConfig{Servers: []ICEServerConfig{}}
+	if *iceServersPath != "" {
+		if err := readJSONFile(*iceServersPath, config); err != nil {
+			return err
+		}
+	}
+
+	if urls := splitURLs(*stunURLs); len(urls) > 0 {
+		config.Servers = append(config.Servers, ICEServerConfig{URLs: urls})
+	}
+	if urls := splitURLs(*turnURLs); len(urls) > 0 {
+		if *turnSecret == "" {
+			return fmt.Errorf("-turn requires -turn-secret")
+		}
+		config.Servers = append(config.Servers, ICEServerConfig{URLs: urls, Secret: *turnSecret})
+	}
+
+	for _, server := range config.Servers {
+		if len(server.URLs) == 0 {
+			return fmt.Errorf("ice server without urls")
+		}
+	}
+
+	iceConfig = config
+	return nil
+}
+
+// turnCredential mints a TURN REST API credential for name that expires
+// after ttl: the username is the expiry time and name, and the password the
+// HMAC-SHA1 of the username keyed with the shared secret.
+func turnCredential(secret string, name string, ttl time.Duration) (string, string) {
+	username := fmt.Sprintf("%d:%s", time.Now().Add(ttl).Unix(), name)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// iceServers returns the ICE servers for the connection of p, minting fresh
+// credentials for the TURN servers sharing a secret with the broker and for
+// the embedded TURN server.
+func iceServers(p *protocol) []webrtc.ICEServer {
+	name := p.identity.Name
+	servers := []webrtc.ICEServer{}
+	if server := startTURNSession(p); server != nil {
+		servers = append(servers, *server)
+	}
+	for _, config := range iceConfig.Servers {
+		server := webrtc.ICEServer{URLs: config.URLs}
+		if config.Secret != "" {
+			username, credential := turnCredential(config.Secret, name, *turnTTL)
+			server.Username = username
+			server.Credential = credential
+		} else if config.Username != "" {
+			server.Username = config.Username
+			server.Credential = config.Credential
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// withICEServers returns payload with fresh ICE servers for the connection of
+// p if it creates or announces a peer, so that the TURN credentials of a peer
+// are minted when it is created rather than when its end connected.
+func (p *protocol) withICEServers(method string, payload interface{}) interface{} {
+	switch payload := payload.(type) {
+	case *proto.CreatePeerRequest:
+		if method == "create-peer" {
+			createPeerRequest := *payload
+			createPeerRequest.ICEServers = iceServers(p)
+			return &createPeerRequest
+		}
+	case *proto.CreatePeerResponse:
+		if method == "announce" {
+			createPeerResponse := *payload
+			createPeerResponse.ICEServers = iceServers(p)
+			return &createPeerResponse
+		}
+	}
+	return payload
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/grexie/vault/protocol"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+func TestWithICEServers(t *testing.T) {
+	defer func(config *ICEConfig, ttl *time.Duration) { iceConfig, turnTTL = config, ttl }(iceConfig, turnTTL)
+	ttl := time.Hour
+	turnTTL = &ttl
+	iceConfig = &ICEConfig{Servers: []ICEServerConfig{
+		{URLs: []string{"stun:stun.example.com"}},
+		{URLs: []string{"turn:turn.example.com"}, Secret: "secret"},
+	}}
+
+	p := &protocol{identity: &Identity{Name: "svc"}}
+
+	iceServersOf := func(payload interface{}) []webrtc.ICEServer {
+		switch payload := payload.(type) {
+		case *proto.CreatePeerRequest:
+			return payload.ICEServers
+		case *proto.CreatePeerResponse:
+			return payload.ICEServers
+		}
+		return nil
+	}
+
+	tests := []struct {
+		method  string
+		payload interface{}
+		minted  bool
+	}{
+		{"create-peer", &proto.CreatePeerRequest{ID: "peer"}, true},
+		{"announce", &proto.CreatePeerResponse{ID: "peer"}, true},
+		{"answer", &proto.CreatePeerResponse{ID: "peer"}, false},
+		{"delete-peer", &proto.DeletePeerRequest{ID: "peer"}, false},
+	}
+
+	for _, test := range tests {
+		payload := p.withICEServers(test.method, test.payload)
+		servers := iceServersOf(payload)
+		if !test.minted {
+			if payload != test.payload {
+				t.Errorf("%v: payload was replaced", test.method)
+			}
+			continue
+		} else if len(iceServersOf(test.payload)) != 0 {
+			t.Errorf("%v: payload was modified", test.method)
+		} else if len(servers) != 2 {
+			t.Fatalf("%v: got %v ice servers, want 2", test.method, len(servers))
+		}
+
+		turn := servers[1]
+		expiry, name, _ := strings.Cut(turn.Username, ":")
+		mac := hmac.New(sha1.New, []byte("secret"))
+		mac.Write([]byte(turn.Username))
+		if name != "svc" {
+			t.Errorf("%v: minted credentials for %v", test.method, name)
+		} else if unix, err := strconv.ParseInt(expiry, 10, 64); err != nil || time.Until(time.Unix(unix, 0)) < ttl-time.Minute {
+			t.Errorf("%v: minted credentials expiring at %v", test.method, expiry)
+		} else if turn.Credential != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("%v: minted an invalid credential", test.method)
+		} else if servers[0].Username != "" {
+			t.Errorf("%v: minted credentials for a STUN server", test.method)
+		}
+	}
+}
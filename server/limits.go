@@ -0,0 +1,299 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/grexie/vault/hub"
+)
+
+// rateLimit is the rate in requests per second at which a bucket refills,
+// and the number of requests it holds.
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+// rateLimits holds the limits of -rate-limits by method, the limit of "*"
+// applying to the methods not listed.
+var rateLimits = map[string]rateLimit{}
+var allowedOrigins = []string{}
+
+// trustedProxies holds the networks of -trusted-proxies.
+var trustedProxies = []*net.IPNet{}
+
+// connections counts the open connections by remote IP, and by identity once
+// they are connected.
+var connectionsByIP = map[string]int{}
+var connectionsByIdentity = map[string]int{}
+var connectionsMutex = sync.Mutex{}
+
+// tokenBucket admits requests at its rate on average, and up to its burst at
+// once.
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.burst, last: time.Now()}
+}
+
+func (b *tokenBucket) take() bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.rate
+	if b.tokens > b.limit.burst {
+		b.tokens = b.limit.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// parseRateLimits parses a comma separated list of method=rate:burst.
+func parseRateLimits(s string) (map[string]rateLimit, error) {
+	limits := map[string]rateLimit{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		method, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit \"%v\", expected method=rate:burst", entry)
+		}
+		rate, burst, ok := strings.Cut(limit, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit \"%v\", expected method=rate:burst", entry)
+		}
+
+		if rate, err := strconv.ParseFloat(rate, 64); err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate in rate limit \"%v\"", entry)
+		} else if burst, err := strconv.ParseUint(burst, 10, 32); err != nil || burst == 0 {
+			return nil, fmt.Errorf("invalid burst in rate limit \"%v\"", entry)
+		} else {
+			limits[strings.TrimSpace(method)] = rateLimit{rate: rate, burst: float64(burst)}
+		}
+	}
+	return limits, nil
+}
+
+func loadLimits() error {
+	if limits, err := parseRateLimits(*rateLimitsSpec); err != nil {
+		return err
+	} else if *maxMessageSize < 0 || *maxConnectionsPerIP < 0 || *maxConnectionsPerIdentity < 0 {
+		return fmt.Errorf("-max-message-size and the connection limits must not be negative")
+	} else {
+		rateLimits = limits
+	}
+
+	allowedOrigins = []string{}
+	for _, origin := range strings.Split(*allowedOriginsSpec, ",") {
+		if origin = strings.TrimSpace(origin); origin == "*" {
+			allowedOrigins = append(allowedOrigins, origin)
+		} else if origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("invalid origin \"%v\" in -allowed-origins", origin)
+			}
+			allowedOrigins = append(allowedOrigins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+
+	if proxies, err := parseTrustedProxies(*trustedProxiesSpec); err != nil {
+		return err
+	} else {
+		trustedProxies = proxies
+	}
+	return nil
+}
+
+// parseTrustedProxies parses a comma separated list of IPs and CIDRs.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, proxy := range strings.Split(s, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		} else if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip == nil {
+				return nil, fmt.Errorf("invalid proxy \"%v\" in -trusted-proxies", proxy)
+			} else if ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		if _, network, err := net.ParseCIDR(proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy \"%v\" in -trusted-proxies", proxy)
+		} else {
+			proxies = append(proxies, network)
+		}
+	}
+	return proxies, nil
+}
+
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range trustedProxies {
+		if parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin accepts requests from an origin of -allowed-origins, or from
+// the host of the server when it is empty. Requests without an Origin header
+// are not sent by browsers and are always accepted.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(allowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the client of r. Behind a proxy of
+// -trusted-proxies it is the last address of X-Forwarded-For not added by a
+// trusted proxy, as the addresses before it may be forged by the client.
+func remoteIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(ip); i-- {
+		if forwardedIP := strings.TrimSpace(forwarded[i]); net.ParseIP(forwardedIP) == nil {
+			break
+		} else {
+			ip = forwardedIP
+		}
+	}
+	return ip
+}
+
+// admitIP counts a connection from ip, returning false if it has as many
+// connections as -max-connections-per-ip.
+func admitIP(ip string) bool {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if *maxConnectionsPerIP > 0 && connectionsByIP[ip] >= *maxConnectionsPerIP {
+		return false
+	}
+	connectionsByIP[ip]++
+	return true
+}
+
+func releaseIP(ip string) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if connectionsByIP[ip]--; connectionsByIP[ip] <= 0 {
+		delete(connectionsByIP, ip)
+	}
+}
+
+func identityKey(identity *Identity) string {
+	return identity.Tenant + "/" + identity.Name
+}
+
+// admitIdentity counts the connection of p for its identity, failing if the
+// identity has as many connections as -max-connections-per-identity. A
+// connection resuming the session of one still open is admitted, as it
+// replaces it. The mutex must be held.
+func (p *protocol) admitIdentity(resumeToken string) error {
+	key := identityKey(p.identity)
+
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	count := connectionsByIdentity[key]
+	if previous, ok := sessions[resumeToken]; ok && previous.expiry == nil && identityKey(previous.identity) == key {
+		count--
+	}
+	if *maxConnectionsPerIdentity > 0 && count >= *maxConnectionsPerIdentity {
+		return hub.Errorf(hub.CodeResourceExhausted, "too many connections for %v", p.identity.Name)
+	}
+
+	connectionsByIdentity[key]++
+	p.admitted = true
+	return nil
+}
+
+func (p *protocol) releaseIdentity() {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if !p.admitted {
+		return
+	}
+	p.admitted = false
+	key := identityKey(p.identity)
+	if connectionsByIdentity[key]--; connectionsByIdentity[key] <= 0 {
+		delete(connectionsByIdentity, key)
+	}
+}
+
+// rateLimiter returns an interceptor closing the connection of p with a
+// policy violation when it sends requests faster than -rate-limits allow.
+func (p *protocol) rateLimiter() func(hub.ResponseWriter, *hub.Request) error {
+	buckets := map[string]*tokenBucket{}
+	bucketsMutex := sync.Mutex{}
+
+	return func(res hub.ResponseWriter, req *hub.Request) error {
+		limit, ok := rateLimits[req.Method]
+		if !ok {
+			if limit, ok = rateLimits["*"]; !ok {
+				return nil
+			}
+		}
+
+		bucketsMutex.Lock()
+		bucket, ok := buckets[req.Method]
+		if !ok {
+			bucket = newTokenBucket(limit)
+			buckets[req.Method] = bucket
+		}
+		allowed := bucket.take()
+		bucketsMutex.Unlock()
+
+		if !allowed {
+			err := hub.Errorf(hub.CodeResourceExhausted, "rate limit of %v exceeded", req.Method)
+			log.Println("rejected:", p.sessionID(), err)
+			closeConnection(p.conn, websocket.ClosePolicyViolation, err.Message)
+			return err
+		}
+		return nil
+	}
+}
+
+// closeConnection sends a close frame with code and reason before closing c.
+func closeConnection(c *websocket.Conn, code int, reason string) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	c.Close()
+}
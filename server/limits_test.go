@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   rateLimit
+		tokens  float64
+		elapsed time.Duration
+		takes   int
+		want    int
+	}{
+		{"burst", rateLimit{rate: 1, burst: 5}, 5, 0, 10, 5},
+		{"empty", rateLimit{rate: 1, burst: 5}, 0, 0, 10, 0},
+		{"refills at rate", rateLimit{rate: 10, burst: 5}, 0, 250 * time.Millisecond, 10, 2},
+		{"refills up to burst", rateLimit{rate: 10, burst: 5}, 0, time.Hour, 10, 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := newTokenBucket(test.limit)
+			bucket.tokens = test.tokens
+			bucket.last = time.Now().Add(-test.elapsed)
+
+			taken := 0
+			for i := 0; i < test.takes; i++ {
+				if bucket.take() {
+					taken++
+				}
+			}
+			if taken != test.want {
+				t.Errorf("took %v tokens, want %v", taken, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]rateLimit
+		fail bool
+	}{
+		{"", map[string]rateLimit{}, false},
+		{"connect=1:5, *=0.5:2", map[string]rateLimit{"connect": {1, 5}, "*": {0.5, 2}}, false},
+		{"connect", nil, true},
+		{"connect=1", nil, true},
+		{"connect=0:5", nil, true},
+		{"connect=1:0", nil, true},
+		{"connect=x:5", nil, true},
+	}
+
+	for _, test := range tests {
+		limits, err := parseRateLimits(test.spec)
+		if test.fail {
+			if err == nil {
+				t.Errorf("parseRateLimits(%q) = %v, want an error", test.spec, limits)
+			}
+		} else if err != nil {
+			t.Errorf("parseRateLimits(%q): %v", test.spec, err)
+		} else if !reflect.DeepEqual(limits, test.want) {
+			t.Errorf("parseRateLimits(%q) = %v, want %v", test.spec, limits, test.want)
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = []*net.IPNet{} }()
+	trustedProxies = proxies
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", "1.2.3.4:1000", nil, "1.2.3.4"},
+		{"untrusted proxy", "1.2.3.4:1000", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"trusted proxy", "10.0.0.1:1000", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"trusted host", "192.168.1.1:1000", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"chained proxies", "10.0.0.1:1000", []string{"5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"forged by the client", "10.0.0.1:1000", []string{"9.9.9.9, 5.6.7.8"}, "5.6.7.8"},
+		{"several headers", "10.0.0.1:1000", []string{"9.9.9.9", "5.6.7.8"}, "5.6.7.8"},
+		{"only proxies", "10.0.0.1:1000", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"invalid", "10.0.0.1:1000", []string{"unknown"}, "10.0.0.1"},
+		{"no header", "10.0.0.1:1000", nil, "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		r := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+		for _, value := range test.forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := remoteIP(r); ip != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, ip, test.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("parsed an invalid CIDR")
+	} else if _, err := parseTrustedProxies("proxy"); err == nil {
+		t.Error("parsed an invalid IP")
+	}
+}
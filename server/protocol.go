@@ -1,99 +1,239 @@
 package server
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"log"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/grexie/vault/broker"
 	"github.com/grexie/vault/hub"
 	proto "github.com/grexie/vault/protocol"
 	"github.com/grexie/vault/webrtc"
 )
 
-var protocols = map[proto.ConnectType]map[string]*protocol{}
+// protocols holds the connections of this replica by session ID, and peers the
+// peers with a connection on this replica by peer ID.
+var protocols = map[string]*protocol{}
 var peers = map[string]*peer{}
 var mutex = sync.Mutex{}
 
 type peer struct {
-	service *protocol
-	user    *protocol
+	service broker.Presence
+	user    broker.Presence
 }
 
+// protocol is a connection to the server. Its id is the session ID, the hub
+// ID of the connection that started the session, which a resumed connection
+// takes over while its own hub keeps serving requests under its own ID.
 type protocol struct {
 	sync.Mutex
+	id             string
 	hub            *hub.Hub
+	httpRequest    *http.Request
 	connected      bool
+	connecting     bool
 	connectRequest proto.ConnectRequest
+	challenge      []byte
+	identity       *Identity
+	presence       broker.Presence
 	peers          map[string]bool
+	conn           *websocket.Conn
+	resumeToken    string
+	resumed        bool
+	expiry         *time.Timer
+	admitted       bool
 }
 
-func newProtocol(hub *hub.Hub) (*protocol, error) {
+var errNotConnected = hub.NewError(hub.CodeUnauthenticated, "not connected")
+
+// requestTimeout bounds how long the server waits for a peer to answer while
+// brokering a connection between a service and a user.
+const requestTimeout = 30 * time.Second
+
+func newProtocol(h *hub.Hub, conn *websocket.Conn, httpRequest *http.Request) (*protocol, error) {
 	p := &protocol{
-		Mutex: sync.Mutex{},
-		hub:   hub,
-		peers: map[string]bool{},
+		Mutex:       sync.Mutex{},
+		id:          h.ID,
+		hub:         h,
+		conn:        conn,
+		httpRequest: httpRequest,
+		peers:       map[string]bool{},
 	}
-	hub.Handle("connect", p.onConnect)
-	hub.Handle("delete-peer", p.onDeletePeer)
-	hub.Handle("ice-candidate", p.onICECandidate)
+	h.Intercept(p.rateLimiter())
+	hub.HandleTyped(h, "challenge", p.onChallenge)
+	h.Handle("connect", p.onConnect)
+	hub.HandleTyped(h, "delete-peer", p.onDeletePeer)
+	hub.HandleTyped(h, "ice-candidate", p.onICECandidate)
 
 	return p, nil
 }
 
+// Done ends the session of p when its connection closes, unless it is kept
+// for a resumed connection to take over.
 func (p *protocol) Done() {
-	for peer := range p.peers {
-		p.deletePeer(peer)
+	p.releaseIdentity()
+	if !p.isConnected() {
+		return
 	}
 
 	mutex.Lock()
-	if protocolsOfType, ok := protocols[p.connectRequest.Type]; ok {
-		delete(protocolsOfType, p.hub.ID)
-		if len(protocolsOfType) == 0 {
-			delete(protocols, p.connectRequest.Type)
+	if p.resumed {
+		mutex.Unlock()
+		return
+	}
+	suspended := p.suspend()
+	if suspended {
+		p.presence.Suspended = true
+		if err := presenceBroker.Join(p.presence); err != nil {
+			log.Println(err)
 		}
+	} else if err := presenceBroker.Leave(p.presence); err != nil {
+		log.Println(err)
 	}
 	mutex.Unlock()
 
-	log.Println("disconnected:", p.connectRequest.Type, p.hub.ID)
+	if suspended {
+		log.Println("suspended:", p.connectRequest.Type, p.sessionID(), "for", *resumeGrace)
+		return
+	}
+
+	p.end()
+	mutex.Lock()
+	delete(protocols, p.sessionID())
+	mutex.Unlock()
+	log.Println("disconnected:", p.connectRequest.Type, p.sessionID())
 
 	log.Println("len of peers", len(peers), len(p.peers))
 }
 
-func (p *protocol) announce(user *protocol) error {
-	var createPeerResponse proto.CreatePeerResponse
+func (p *protocol) sessionID() string {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.id
+}
+
+func (p *protocol) isConnected() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.connected
+}
+
+// end deletes the peers of p and its TURN credentials.
+func (p *protocol) end() {
+	p.Lock()
+	ids := []string{}
+	for id := range p.peers {
+		ids = append(ids, id)
+	}
+	p.Unlock()
+
+	for _, id := range ids {
+		p.deletePeer(id)
+	}
+	endTURNSession(p)
+}
+
+// addPeer records a peer between service and user, at least one of which is
+// connected to this replica.
+func addPeer(id string, service broker.Presence, user broker.Presence) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	peers[id] = &peer{
+		service: service,
+		user:    user,
+	}
+	for _, presence := range []broker.Presence{service, user} {
+		if p, ok := protocols[presence.ID]; ok {
+			p.Lock()
+			p.peers[id] = true
+			p.Unlock()
+		}
+	}
+}
+
+func forgetPeer(id string) (*peer, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	peer, ok := peers[id]
+	if !ok {
+		return nil, false
+	}
+
+	delete(peers, id)
+	for _, presence := range []broker.Presence{peer.service, peer.user} {
+		if p, ok := protocols[presence.ID]; ok {
+			p.Lock()
+			delete(p.peers, id)
+			p.Unlock()
+		}
+	}
+	return peer, true
+}
+
+// peeredWith reports whether p has a peer with user.
+func (p *protocol) peeredWith(user broker.Presence) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	p.Lock()
+	defer p.Unlock()
+
+	for id := range p.peers {
+		if peer, ok := peers[id]; ok && peer.user.ID == user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// remote returns the end of the peer that is not p.
+func (p *protocol) remote(peer *peer) (broker.Presence, bool) {
+	if peer.service.ID == p.sessionID() {
+		return peer.user, true
+	} else if peer.user.ID == p.sessionID() {
+		return peer.service, true
+	} else {
+		return broker.Presence{}, false
+	}
+}
+
+// announce offers a peer connection with user to service. Either may be
+// connected to another replica, in which case the requests are relayed to
+// it.
+func announce(service broker.Presence, user broker.Presence) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
 
-	if res, err := p.hub.RequestSync("create-peer", &proto.CreatePeerRequest{
+	if !routable(service, user) {
+		return nil
+	} else if createPeerResponse, err := call[proto.CreatePeerResponse](ctx, service, user, "create-peer", &proto.CreatePeerRequest{
 		ID: uuid.NewString(),
+		User: &proto.PeerIdentity{
+			Name:   user.Name,
+			Tenant: user.Tenant,
+		},
+		Codecs: user.Codecs,
 	}); err != nil {
 		log.Println(err)
 		return err
-	} else if bytes, err := json.Marshal(res); err != nil {
-		log.Println(err)
-		return err
-	} else if err := json.Unmarshal(bytes, &createPeerResponse); err != nil {
-		log.Println(err)
-		return err
 	} else {
-		mutex.Lock()
-		peers[createPeerResponse.ID] = &peer{
-			service: p,
-			user:    user,
-		}
-		mutex.Unlock()
+		addPeer(createPeerResponse.ID, service, user)
 
-		p.Lock()
-		user.Lock()
-		p.peers[createPeerResponse.ID] = true
-		user.peers[createPeerResponse.ID] = true
-		user.Unlock()
-		p.Unlock()
-
-		if res, err := user.hub.RequestSync("announce", createPeerResponse); err != nil {
+		// payloads are decoded and encoded again, as the service and the
+		// user may not use the same codec
+		if answer, err := call[proto.CreatePeerResponse](ctx, user, service, "announce", &createPeerResponse); err != nil {
 			log.Println(err)
 			return err
-		} else if _, err := p.hub.RequestSync("answer", res); err != nil {
+		} else if _, err := call[interface{}](ctx, service, user, "answer", &answer); err != nil {
 			return err
 		} else {
 			log.Println("answer responded")
@@ -102,105 +242,205 @@ func (p *protocol) announce(user *protocol) error {
 	}
 }
 
-func (p *protocol) onICECandidate(res hub.ResponseWriter, req *hub.Request) error {
-	var iceCandidate webrtc.ICECandidate
+func (p *protocol) onICECandidate(req *hub.Request, iceCandidate webrtc.ICECandidate) (interface{}, error) {
+	if !p.isConnected() {
+		return nil, errNotConnected
+	}
 
-	if bytes, err := json.Marshal(req.Payload); err != nil {
-		return err
-	} else if err := json.Unmarshal(bytes, &iceCandidate); err != nil {
-		return err
-	} else {
-		mutex.Lock()
-		peer, ok := peers[iceCandidate.ID]
-		mutex.Unlock()
+	mutex.Lock()
+	peer, ok := peers[iceCandidate.ID]
+	mutex.Unlock()
 
-		if !ok {
-			return errors.New("peer not found")
-		} else if p.connectRequest.Type == proto.CONNECT_TYPE_SERVICE {
-			return peer.user.hub.RequestWithoutResponse("ice-candidate", req.Payload)
-		} else if p.connectRequest.Type == proto.CONNECT_TYPE_USER {
-			return peer.service.hub.RequestWithoutResponse("ice-candidate", req.Payload)
-		} else {
-			return errors.New("protocol error")
-		}
+	if !ok {
+		return nil, hub.NewError(hub.CodeNotFound, "peer not found")
+	} else if remote, ok := p.remote(peer); !ok {
+		return nil, hub.NewError(hub.CodeNotFound, "peer not found")
+	} else {
+		return nil, notify(remote, p.presence, "ice-candidate", &iceCandidate)
 	}
 }
 
+// deletePeer forgets the peer id of p and tells its remote end. Peers of
+// other connections are left alone.
 func (p *protocol) deletePeer(id string) error {
 	mutex.Lock()
-	if peer, ok := peers[id]; !ok {
-		mutex.Unlock()
-		return errors.New("peer not found")
-	} else {
-		peer.service.Lock()
-		peer.user.Lock()
-		delete(peer.service.peers, id)
-		delete(peer.user.peers, id)
-		delete(peers, id)
-		peer.user.Unlock()
-		peer.service.Unlock()
-		mutex.Unlock()
+	peer, ok := peers[id]
+	mutex.Unlock()
 
-		if p.connectRequest.Type == proto.CONNECT_TYPE_SERVICE {
-			return peer.user.hub.RequestWithoutResponse("delete-peer", &proto.DeletePeerRequest{ID: id})
-		} else if p.connectRequest.Type == proto.CONNECT_TYPE_USER {
-			return peer.user.hub.RequestWithoutResponse("delete-peer", &proto.DeletePeerRequest{ID: id})
-		} else {
-			return nil
-		}
+	if !ok {
+		return hub.NewError(hub.CodeNotFound, "peer not found")
+	} else if remote, ok := p.remote(peer); !ok {
+		return hub.NewError(hub.CodeNotFound, "peer not found")
+	} else if _, ok := forgetPeer(id); !ok {
+		return hub.NewError(hub.CodeNotFound, "peer not found")
+	} else {
+		return notify(remote, p.presence, "delete-peer", &proto.DeletePeerRequest{ID: id})
 	}
 }
 
-func (p *protocol) onDeletePeer(res hub.ResponseWriter, req *hub.Request) error {
-	var deletePeerRequest proto.DeletePeerRequest
-	if bytes, err := json.Marshal(req.Payload); err != nil {
-		return err
-	} else if err := json.Unmarshal(bytes, &deletePeerRequest); err != nil {
-		return err
+func (p *protocol) onDeletePeer(req *hub.Request, deletePeerRequest proto.DeletePeerRequest) (interface{}, error) {
+	if !p.isConnected() {
+		return nil, errNotConnected
 	} else {
-		return p.deletePeer(deletePeerRequest.ID)
+		return nil, p.deletePeer(deletePeerRequest.ID)
+	}
+}
+
+func (p *protocol) onChallenge(req *hub.Request, _ interface{}) (*proto.ChallengeResponse, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
 	}
+
+	p.Lock()
+	p.challenge = challenge
+	p.Unlock()
+
+	return &proto.ChallengeResponse{
+		Challenge: base64.StdEncoding.EncodeToString(challenge),
+	}, nil
 }
 
+// onConnect writes its response before announcing the new peer, so that the
+// peer knows its connection parameters when the announcements arrive.
 func (p *protocol) onConnect(res hub.ResponseWriter, req *hub.Request) error {
-	if p.connected {
-		return errors.New("already connected")
+	p.Lock()
+	if p.connected || p.connecting {
+		p.Unlock()
+		return hub.NewError(hub.CodeFailedPrecondition, "already connected")
+	}
+	p.connecting = true
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		p.connecting = false
+		p.Unlock()
+	}()
+
+	connectRequest, err := hub.Decode[proto.ConnectRequest](req)
+	if err != nil {
+		return err
+	} else if connectRequest.Type != proto.CONNECT_TYPE_SERVICE && connectRequest.Type != proto.CONNECT_TYPE_USER {
+		return hub.Errorf(hub.CodeInvalidArgument, "invalid connect type \"%v\"", connectRequest.Type)
+	}
+
+	version, ok := proto.NegotiateVersion(connectRequest.Version)
+	if !ok {
+		log.Println("rejected:", connectRequest.Type, p.sessionID(), "protocol version", connectRequest.Version)
+		return hub.Errorf(hub.CodeFailedPrecondition, "unsupported protocol version %v, the server speaks versions %v to %v", connectRequest.Version, proto.MIN_PROTOCOL_VERSION, proto.PROTOCOL_VERSION).WithDetails(map[string]interface{}{
+			"minVersion": proto.MIN_PROTOCOL_VERSION,
+			"maxVersion": proto.PROTOCOL_VERSION,
+		})
 	}
 
-	if bytes, err := json.Marshal(req.Payload); err != nil {
+	p.Lock()
+	challenge := p.challenge
+	p.challenge = nil
+	p.Unlock()
+
+	identity, err := authenticate(&AuthenticationRequest{
+		ConnectRequest: &connectRequest,
+		Challenge:      challenge,
+		HTTPRequest:    p.httpRequest,
+	})
+	if err != nil {
+		log.Println("rejected:", connectRequest.Type, p.sessionID(), err)
 		return err
-	} else if err := json.Unmarshal(bytes, &p.connectRequest); err != nil {
+	}
+
+	labels, err := identity.labels(connectRequest.Labels)
+	if err != nil {
+		log.Println("rejected:", connectRequest.Type, p.sessionID(), err)
 		return err
 	}
 
-	p.connected = true
+	// only services resume, and only those that know to send the token back
+	resumeToken := ""
+	if connectRequest.Type == proto.CONNECT_TYPE_SERVICE && proto.HasFeature(connectRequest.Features, proto.FEATURE_RESUME) {
+		if resumeToken, err = newResumeToken(); err != nil {
+			return err
+		}
+	}
+
+	p.connectRequest = connectRequest
+	p.identity = identity
 
 	mutex.Lock()
-	protocolsOfType, ok := protocols[p.connectRequest.Type]
-	if !ok {
-		protocolsOfType = map[string]*protocol{}
-		protocols[p.connectRequest.Type] = protocolsOfType
+	if err := p.admitIdentity(connectRequest.ResumeToken); err != nil {
+		mutex.Unlock()
+		log.Println("rejected:", connectRequest.Type, p.sessionID(), err)
+		closeConnection(p.conn, websocket.CloseTryAgainLater, err.Error())
+		return err
+	}
+	resumed := resumeToken != "" && connectRequest.ResumeToken != "" && p.resume(connectRequest.ResumeToken)
+	if resumeToken != "" {
+		p.resumeToken = resumeToken
+		sessions[resumeToken] = p
+	}
+	p.presence = broker.Presence{
+		ID:       p.sessionID(),
+		Replica:  replicaID,
+		Type:     connectRequest.Type,
+		Name:     identity.Name,
+		Tenant:   identity.Tenant,
+		Labels:   labels,
+		Services: connectRequest.Services,
+		Codecs:   connectRequest.Codecs,
 	}
-	protocolsOfType[p.hub.ID] = p
+	protocols[p.sessionID()] = p
 	mutex.Unlock()
 
-	log.Println("connected:", p.connectRequest.Type, p.hub.ID)
+	if err := presenceBroker.Join(p.presence); err != nil {
+		mutex.Lock()
+		delete(protocols, p.sessionID())
+		delete(sessions, resumeToken)
+		mutex.Unlock()
+		return err
+	}
+	p.Lock()
+	p.connected = true
+	p.Unlock()
+
+	livePeers := []string{}
+	if resumed {
+		p.Lock()
+		for id := range p.peers {
+			livePeers = append(livePeers, id)
+		}
+		p.Unlock()
+		log.Println("resumed:", p.connectRequest.Type, p.sessionID(), "with", len(livePeers), "peers")
+	}
+
+	log.Println("connected:", p.connectRequest.Type, p.sessionID(), p.identity.Name, "protocol version", version)
 	res.Write(&proto.ConnectResponse{
-		ICEServers: []string{},
+		Version:     version,
+		Features:    proto.Features,
+		ICEServers:  iceServers(p),
+		ResumeToken: resumeToken,
+		Resumed:     resumed,
+		Peers:       livePeers,
 	})
 
 	if p.connectRequest.Type == proto.CONNECT_TYPE_USER {
-		if services, ok := protocols[proto.CONNECT_TYPE_SERVICE]; ok {
+		if services, err := presenceBroker.Presences(proto.CONNECT_TYPE_SERVICE); err != nil {
+			return err
+		} else {
 			for _, service := range services {
-				if err := service.announce(p); err != nil {
+				if err := announce(service, p.presence); err != nil {
 					return err
 				}
 			}
 		}
 	} else if p.connectRequest.Type == proto.CONNECT_TYPE_SERVICE {
-		if users, ok := protocols[proto.CONNECT_TYPE_USER]; ok {
+		if users, err := presenceBroker.Presences(proto.CONNECT_TYPE_USER); err != nil {
+			return err
+		} else {
 			for _, user := range users {
-				if err := p.announce(user); err != nil {
+				// a resumed service keeps the peers it has
+				if p.peeredWith(user) {
+					continue
+				} else if err := announce(p.presence, user); err != nil {
 					return err
 				}
 			}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/grexie/vault/broker"
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+)
+
+func newTestProtocol(id string, connectType proto.ConnectType) (*protocol, *recorder) {
+	writer := &recorder{}
+	p := &protocol{
+		id:       id,
+		hub:      hub.NewHub(writer),
+		peers:    map[string]bool{},
+		presence: broker.Presence{ID: id, Replica: replicaID, Type: connectType},
+	}
+	return p, writer
+}
+
+func TestDeletePeer(t *testing.T) {
+	service, _ := newTestProtocol("service", proto.CONNECT_TYPE_SERVICE)
+	user, userWriter := newTestProtocol("user", proto.CONNECT_TYPE_USER)
+	stranger, _ := newTestProtocol("stranger", proto.CONNECT_TYPE_USER)
+
+	mutex.Lock()
+	for _, p := range []*protocol{service, user, stranger} {
+		protocols[p.id] = p
+	}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		for _, p := range []*protocol{service, user, stranger} {
+			delete(protocols, p.id)
+		}
+		peers = map[string]*peer{}
+		mutex.Unlock()
+	}()
+
+	addPeer("peer", service.presence, user.presence)
+
+	tests := []struct {
+		name   string
+		p      *protocol
+		id     string
+		kept   bool
+		denied bool
+	}{
+		{"another connection", stranger, "peer", true, true},
+		{"missing peer", service, "missing", true, true},
+		{"an end of the peer", service, "peer", false, false},
+		{"a deleted peer", user, "peer", false, true},
+	}
+
+	for _, test := range tests {
+		err := test.p.deletePeer(test.id)
+		if test.denied && !errors.Is(err, hub.ErrNotFound) {
+			t.Errorf("%v: got %v, want not found", test.name, err)
+		} else if !test.denied && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+
+		mutex.Lock()
+		_, kept := peers["peer"]
+		mutex.Unlock()
+		service.Lock()
+		keptByService := service.peers["peer"]
+		service.Unlock()
+		if kept != test.kept || keptByService != test.kept {
+			t.Errorf("%v: peer kept = %v and by the service = %v, want %v", test.name, kept, keptByService, test.kept)
+		}
+	}
+
+	userWriter.Lock()
+	if len(userWriter.methods) != 1 || userWriter.methods[0] != "delete-peer" {
+		t.Errorf("user was sent %v, want delete-peer", userWriter.methods)
+	}
+	userWriter.Unlock()
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grexie/vault/broker"
+	"github.com/grexie/vault/hub"
+	proto "github.com/grexie/vault/protocol"
+	"github.com/grexie/vault/webrtc"
+)
+
+// replicaID identifies this replica to the others sharing the broker.
+var replicaID = uuid.NewString()
+
+var presenceBroker broker.Broker
+
+// replicas holds a hub per replica this replica talks to. Their messages are
+// carried by the broker, and their requests relay the signalling of the
+// connections of one replica to those of another.
+var replicas = map[string]*hub.Hub{}
+var replicasMutex = sync.Mutex{}
+
+type replicaFrame struct {
+	From    string `json:"from"`
+	Message []byte `json:"message"`
+}
+
+type replicaWriter struct {
+	replica string
+}
+
+func (w *replicaWriter) WriteMessage(messageType int, data []byte) error {
+	if frame, err := json.Marshal(&replicaFrame{From: replicaID, Message: data}); err != nil {
+		return err
+	} else {
+		return presenceBroker.Publish(w.replica, frame)
+	}
+}
+
+// relayRequest carries a request to the connection To on another replica,
+// sent on behalf of the connection From.
+type relayRequest[T any] struct {
+	To      string          `json:"to"`
+	From    broker.Presence `json:"from"`
+	Payload T               `json:"payload"`
+}
+
+func replicaHub(replica string) *hub.Hub {
+	replicasMutex.Lock()
+	defer replicasMutex.Unlock()
+
+	if h, ok := replicas[replica]; ok {
+		return h
+	}
+
+	h := hub.NewHub(&replicaWriter{replica: replica})
+	handleRelay(h, "create-peer", onRelayCreatePeer)
+	handleRelay(h, "announce", onRelayAnnounce)
+	handleRelay(h, "answer", onRelayAnswer)
+	handleRelay(h, "ice-candidate", onRelayICECandidate)
+	handleRelay(h, "delete-peer", onRelayDeletePeer)
+	replicas[replica] = h
+	return h
+}
+
+func startBroker() error {
+	if err := presenceBroker.Subscribe(replicaID, func(message []byte) {
+		frame := &replicaFrame{}
+		if err := json.Unmarshal(message, frame); err != nil {
+			log.Println("broker:", err)
+		} else if err := replicaHub(frame.From).ProcessMessage(frame.Message); err != nil {
+			log.Println("broker:", err)
+		}
+	}); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(*sweepInterval) {
+			if err := sweepReplicas(); err != nil {
+				log.Println("broker:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// sweepReplicas forgets the peers whose end on another replica is no longer
+// present, as when that replica stopped running, and tells the end connected
+// to this replica. The hubs of replicas without any connection are closed.
+func sweepReplicas() error {
+	// peers added after the presences are listed are not swept, as their
+	// ends may have joined since
+	mutex.Lock()
+	swept := map[string]*peer{}
+	for id, peer := range peers {
+		swept[id] = peer
+	}
+	mutex.Unlock()
+
+	present := map[string]bool{}
+	live := map[string]bool{}
+	for _, connectType := range []proto.ConnectType{proto.CONNECT_TYPE_SERVICE, proto.CONNECT_TYPE_USER} {
+		if presences, err := presenceBroker.Presences(connectType); err != nil {
+			return err
+		} else {
+			for _, presence := range presences {
+				present[presence.ID] = true
+				live[presence.Replica] = true
+			}
+		}
+	}
+
+	for id, peer := range swept {
+		gone, other := peer.service, peer.user
+		if gone.Replica == replicaID || present[gone.ID] {
+			gone, other = peer.user, peer.service
+		}
+		if gone.Replica == replicaID || present[gone.ID] {
+			continue
+		}
+
+		log.Println("peer expired:", id, "with", gone.Type, gone.ID, "of replica", gone.Replica)
+		forgetPeer(id)
+		if other.Replica == replicaID {
+			if err := notify(other, gone, "delete-peer", &proto.DeletePeerRequest{ID: id}); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	replicasMutex.Lock()
+	defer replicasMutex.Unlock()
+
+	for replica, h := range replicas {
+		if !live[replica] {
+			h.Close(errors.New("replica " + replica + " has no connections"))
+			delete(replicas, replica)
+		}
+	}
+	return nil
+}
+
+// handleRelay registers a handler for requests relayed to the connections of
+// this replica.
+func handleRelay[Req any, Res any](h *hub.Hub, method string, handlerFn func(*hub.Request, *protocol, broker.Presence, Req) (Res, error)) {
+	hub.HandleTyped(h, method, func(req *hub.Request, relay relayRequest[Req]) (Res, error) {
+		mutex.Lock()
+		p, ok := protocols[relay.To]
+		mutex.Unlock()
+
+		if !ok {
+			var res Res
+			return res, hub.Errorf(hub.CodeNotFound, "connection %v not found", relay.To)
+		}
+		return handlerFn(req, p, relay.From, relay.Payload)
+	})
+}
+
+// call sends a request to the connection of to on behalf of from, relaying
+// it through the replica to is connected to.
+func call[Res any](ctx context.Context, to broker.Presence, from broker.Presence, method string, payload interface{}) (Res, error) {
+	if to.Replica != replicaID {
+		return hub.CallContext[Res](ctx, replicaHub(to.Replica), method, &relayRequest[interface{}]{
+			To:      to.ID,
+			From:    from,
+			Payload: payload,
+		})
+	}
+
+	mutex.Lock()
+	p, ok := protocols[to.ID]
+	mutex.Unlock()
+
+	if !ok {
+		var res Res
+		return res, hub.Errorf(hub.CodeNotFound, "connection %v not found", to.ID)
+	}
+	return hub.CallContext[Res](ctx, p.hub, method, p.withICEServers(method, payload))
+}
+
+// notify sends a request expecting no response to the connection of to on
+// behalf of from, relaying it through the replica to is connected to.
+func notify(to broker.Presence, from broker.Presence, method string, payload interface{}) error {
+	if to.Replica != replicaID {
+		return replicaHub(to.Replica).RequestWithoutResponse(method, &relayRequest[interface{}]{
+			To:      to.ID,
+			From:    from,
+			Payload: payload,
+		})
+	}
+
+	mutex.Lock()
+	p, ok := protocols[to.ID]
+	mutex.Unlock()
+
+	if !ok {
+		return hub.Errorf(hub.CodeNotFound, "connection %v not found", to.ID)
+	}
+	return p.hub.RequestWithoutResponse(method, payload)
+}
+
+func onRelayCreatePeer(req *hub.Request, service *protocol, user broker.Presence, createPeerRequest proto.CreatePeerRequest) (*proto.CreatePeerResponse, error) {
+	if createPeerResponse, err := hub.CallContext[proto.CreatePeerResponse](req.Context(), service.hub, "create-peer", service.withICEServers("create-peer", &createPeerRequest)); err != nil {
+		return nil, err
+	} else {
+		addPeer(createPeerResponse.ID, service.presence, user)
+		return &createPeerResponse, nil
+	}
+}
+
+func onRelayAnnounce(req *hub.Request, user *protocol, service broker.Presence, createPeerResponse proto.CreatePeerResponse) (*proto.CreatePeerResponse, error) {
+	addPeer(createPeerResponse.ID, service, user.presence)
+	if answer, err := hub.CallContext[proto.CreatePeerResponse](req.Context(), user.hub, "announce", user.withICEServers("announce", &createPeerResponse)); err != nil {
+		return nil, err
+	} else {
+		return &answer, nil
+	}
+}
+
+func onRelayAnswer(req *hub.Request, service *protocol, user broker.Presence, answer proto.CreatePeerResponse) (interface{}, error) {
+	_, err := service.hub.RequestContext(req.Context(), "answer", &answer)
+	return nil, err
+}
+
+func onRelayICECandidate(req *hub.Request, p *protocol, from broker.Presence, iceCandidate webrtc.ICECandidate) (interface{}, error) {
+	return nil, p.hub.RequestWithoutResponse("ice-candidate", &iceCandidate)
+}
+
+func onRelayDeletePeer(req *hub.Request, p *protocol, from broker.Presence, deletePeerRequest proto.DeletePeerRequest) (interface{}, error) {
+	forgetPeer(deletePeerRequest.ID)
+	return nil, p.hub.RequestWithoutResponse("delete-peer", &deletePeerRequest)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/grexie/vault/broker"
+	"github.com/grexie/vault/broker/memory"
+	proto "github.com/grexie/vault/protocol"
+)
+
+// recorder records the methods of the requests written to it.
+type recorder struct {
+	sync.Mutex
+	methods []string
+}
+
+func (r *recorder) WriteMessage(messageType int, data []byte) error {
+	msg := struct {
+		Method string `json:"method"`
+	}{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.methods = append(r.methods, msg.Method)
+	return nil
+}
+
+func TestSweepReplicas(t *testing.T) {
+	b := &memory.MemoryBroker{}
+	if err := b.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	presenceBroker = b
+
+	local, writer := newTestProtocol("user", proto.CONNECT_TYPE_USER)
+
+	live := broker.Presence{ID: "live", Replica: "live-replica", Type: proto.CONNECT_TYPE_SERVICE}
+	suspended := broker.Presence{ID: "suspended", Replica: "live-replica", Type: proto.CONNECT_TYPE_SERVICE, Suspended: true}
+	gone := broker.Presence{ID: "gone", Replica: "gone-replica", Type: proto.CONNECT_TYPE_SERVICE}
+	for _, presence := range []broker.Presence{local.presence, live, suspended} {
+		if err := b.Join(presence); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mutex.Lock()
+	protocols["user"] = local
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(protocols, "user")
+		peers = map[string]*peer{}
+		mutex.Unlock()
+	}()
+
+	addPeer("with-live", live, local.presence)
+	addPeer("with-suspended", suspended, local.presence)
+	addPeer("with-gone", gone, local.presence)
+	replicaHub("live-replica")
+	replicaHub("gone-replica")
+
+	if err := sweepReplicas(); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	for _, test := range []struct {
+		id   string
+		want bool
+	}{
+		{"with-live", true},
+		{"with-suspended", true},
+		{"with-gone", false},
+	} {
+		if _, ok := peers[test.id]; ok != test.want {
+			t.Errorf("peer %v kept = %v, want %v", test.id, ok, test.want)
+		} else if local.peers[test.id] != test.want {
+			t.Errorf("peer %v of the local connection kept = %v, want %v", test.id, local.peers[test.id], test.want)
+		}
+	}
+	mutex.Unlock()
+
+	writer.Lock()
+	if len(writer.methods) != 1 || writer.methods[0] != "delete-peer" {
+		t.Errorf("local connection was sent %v, want delete-peer", writer.methods)
+	}
+	writer.Unlock()
+
+	replicasMutex.Lock()
+	if _, ok := replicas["live-replica"]; !ok {
+		t.Error("closed the hub of a replica with connections")
+	}
+	if _, ok := replicas["gone-replica"]; ok {
+		t.Error("kept the hub of a replica without connections")
+	}
+	replicasMutex.Unlock()
+}
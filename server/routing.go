@@ -0,0 +1,93 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/grexie/vault/broker"
+)
+
+// RoutingRule allows the users matching Users to be announced to the services
+// matching Services within Tenant. Users are matched by identity name and
+// services by identity name, hub ID or "key=value" selector of the labels
+// their identity allows them; "*" matches everything.
+type RoutingRule struct {
+	Tenant   string   `json:"tenant"`
+	Users    []string `json:"users"`
+	Services []string `json:"services"`
+}
+
+type RoutingPolicy struct {
+	Rules []RoutingRule `json:"rules"`
+}
+
+// routingPolicy is nil when no policy is configured, in which case users are
+// announced to every service of their tenant.
+var routingPolicy *RoutingPolicy
+
+func loadRoutingPolicy() error {
+	if *routingPath == "" {
+		return nil
+	}
+
+	policy := &RoutingPolicy{}
+	if err := readJSONFile(*routingPath, policy); err != nil {
+		return err
+	}
+	routingPolicy = policy
+	return nil
+}
+
+func matchesUser(selector string, user broker.Presence) bool {
+	return selector == "*" || selector == user.Name
+}
+
+func matchesService(selector string, service broker.Presence) bool {
+	if selector == "*" || selector == service.Name || selector == service.ID {
+		return true
+	} else if parts := strings.SplitN(selector, "=", 2); len(parts) == 2 {
+		value, ok := service.Labels[parts[0]]
+		return ok && value == parts[1]
+	} else {
+		return false
+	}
+}
+
+func matchesAny(selectors []string, matches func(string) bool) bool {
+	for _, selector := range selectors {
+		if matches(selector) {
+			return true
+		}
+	}
+	return false
+}
+
+// routable reports whether user may be announced to service: both must be
+// connected and belong to the same tenant, the service must be one the user
+// asked for and the routing policy, if any, must allow the pair.
+func routable(service broker.Presence, user broker.Presence) bool {
+	if service.Suspended || user.Suspended || service.Tenant != user.Tenant {
+		return false
+	}
+
+	if len(user.Services) > 0 && !matchesAny(user.Services, func(selector string) bool {
+		return matchesService(selector, service)
+	}) {
+		return false
+	}
+
+	if routingPolicy == nil {
+		return true
+	}
+
+	for _, rule := range routingPolicy.Rules {
+		if rule.Tenant != user.Tenant {
+			continue
+		} else if !matchesAny(rule.Users, func(selector string) bool { return matchesUser(selector, user) }) {
+			continue
+		} else if matchesAny(rule.Services, func(selector string) bool { return matchesService(selector, service) }) {
+			return true
+		}
+	}
+
+	return false
+}
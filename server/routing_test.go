@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/grexie/vault/broker"
+	"github.com/grexie/vault/hub"
+)
+
+func TestIdentityLabels(t *testing.T) {
+	identity := &Identity{Name: "svc", Labels: map[string]string{"env": "prod", "zone": "*"}}
+
+	tests := []struct {
+		declared map[string]string
+		want     map[string]string
+		denied   bool
+	}{
+		{nil, map[string]string{"env": "prod"}, false},
+		{map[string]string{"env": "prod"}, map[string]string{"env": "prod"}, false},
+		{map[string]string{"zone": "a"}, map[string]string{"env": "prod", "zone": "a"}, false},
+		{map[string]string{"env": "dev"}, nil, true},
+		{map[string]string{"team": "x"}, nil, true},
+	}
+
+	for _, test := range tests {
+		labels, err := identity.labels(test.declared)
+		if test.denied {
+			if !errors.Is(err, hub.ErrPermissionDenied) {
+				t.Errorf("labels(%v): got %v, want permission denied", test.declared, err)
+			}
+		} else if err != nil {
+			t.Errorf("labels(%v): %v", test.declared, err)
+		} else if !reflect.DeepEqual(labels, test.want) {
+			t.Errorf("labels(%v) = %v, want %v", test.declared, labels, test.want)
+		}
+	}
+
+	if _, err := (&Identity{Name: "svc"}).labels(map[string]string{"env": "prod"}); err == nil {
+		t.Error("an identity without labels declared env=prod")
+	}
+}
+
+func TestRoutable(t *testing.T) {
+	defer func() { routingPolicy = nil }()
+	routingPolicy = &RoutingPolicy{Rules: []RoutingRule{
+		{Tenant: "acme", Users: []string{"alice"}, Services: []string{"env=prod"}},
+		{Tenant: "acme", Users: []string{"*"}, Services: []string{"shared"}},
+	}}
+
+	prod := broker.Presence{ID: "1", Name: "svc", Tenant: "acme", Labels: map[string]string{"env": "prod"}}
+	dev := broker.Presence{ID: "2", Name: "svc", Tenant: "acme", Labels: map[string]string{"env": "dev"}}
+	shared := broker.Presence{ID: "3", Name: "shared", Tenant: "acme"}
+	other := broker.Presence{ID: "4", Name: "shared", Tenant: "other"}
+
+	alice := broker.Presence{Name: "alice", Tenant: "acme"}
+	bob := broker.Presence{Name: "bob", Tenant: "acme"}
+	aliceShared := broker.Presence{Name: "alice", Tenant: "acme", Services: []string{"shared"}}
+
+	tests := []struct {
+		service broker.Presence
+		user    broker.Presence
+		want    bool
+	}{
+		{prod, alice, true},
+		{dev, alice, false},
+		{shared, alice, true},
+		{other, alice, false},
+		{prod, bob, false},
+		{shared, bob, true},
+		{prod, aliceShared, false},
+		{shared, aliceShared, true},
+	}
+
+	for _, test := range tests {
+		if got := routable(test.service, test.user); got != test.want {
+			t.Errorf("routable(%v, %v) = %v, want %v", test.service.ID, test.user.Name, got, test.want)
+		}
+	}
+}
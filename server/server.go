@@ -3,12 +3,12 @@ package server
 import (
 	"bytes"
 	"flag"
-	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"plugin"
-	"strings"
+	"time"
 
+	brokerPlugin "github.com/grexie/vault/broker"
 	storagePlugin "github.com/grexie/vault/storage"
 )
 
@@ -21,52 +21,115 @@ func (f *QuietFlagSet) failf(format string, a ...interface{}) error {
 }
 
 var addr *string
-var driverPath *string
-var storage storagePlugin.Driver
+var brokerName *string
+var driverName *string
+var authTokensPath *string
+var authKeysPath *string
+var authCertsPath *string
+var allowAnonymous *bool
+var routingPath *string
+var resumeGrace *time.Duration
+var sweepInterval *time.Duration
+var tlsCert *string
+var tlsKey *string
+var clientCA *string
+var allowedOriginsSpec *string
+var maxMessageSize *int64
+var maxConnectionsPerIP *int
+var maxConnectionsPerIdentity *int
+var trustedProxiesSpec *string
+var rateLimitsSpec *string
+var iceServersPath *string
+var stunURLs *string
+var turnURLs *string
+var turnSecret *string
+var turnTTL *time.Duration
+var turnListen *string
+var turnRelayIP *string
+var turnHost *string
 
-func resolveDriverPath() (string, error) {
-	p := *driverPath
+// loadBroker opens the broker, whose flags are parsed along with those of
+// the server.
+func loadBroker() error {
+	name, driver := *brokerName, *driverName
+	flagSet := newFlagSet(flag.ExitOnError)
 
-	if !strings.HasSuffix(p, ".so") {
-		p = fmt.Sprintf("%v.so", p)
-	}
-
-	if _, err := os.Stat(p); err != nil {
-		return "", err
-	} else {
-		return p, nil
-	}
-}
-
-func loadStorageDriver() error {
-	if d, err := resolveDriverPath(); err != nil {
+	if b, err := brokerPlugin.Open(name); err != nil {
+		return err
+	} else if err := b.CreateFlags(flagSet); err != nil {
 		return err
-	} else if p, err := plugin.Open(d); err != nil {
+	} else if deprecated, err := createStorageFlags(flagSet, driver); err != nil {
 		return err
-	} else if d, err := p.Lookup("Driver"); err != nil {
+	} else if err := flagSet.Parse(os.Args[2:]); err != nil {
+		return err
+	} else if err := b.Initialize(); err != nil {
 		return err
-	} else if driver, ok := d.(storagePlugin.Driver); !ok {
-		return fmt.Errorf("%v does not implement storage.Driver", driverPath)
 	} else {
-		flagSet := newFlagSet(flag.ExitOnError)
-
-		if err := driver.CreateFlags(flagSet); err != nil {
-			return err
-		} else if err := flagSet.Parse(os.Args[2:]); err != nil {
-			return err
-		} else if err := driver.Initialize(); err != nil {
-			return err
-		} else {
-			storage = driver
-			return nil
-		}
+		flagSet.Visit(func(f *flag.Flag) {
+			if deprecated[f.Name] {
+				log.Printf("-%v is deprecated and ignored, the server no longer stores data", f.Name)
+			}
+		})
+		presenceBroker = b
+		return nil
+	}
+}
+
+// createStorageFlags adds the flags of the storage driver the server used to
+// keep its data in, so that the command lines of earlier versions still
+// parse. It returns the names of the flags, which are ignored.
+func createStorageFlags(flagSet *flag.FlagSet, driver string) (map[string]bool, error) {
+	deprecated := map[string]bool{"driver": true, "master-key": true}
+
+	d, err := storagePlugin.Open(driver)
+	if err != nil {
+		log.Println(err)
+		return deprecated, nil
+	}
+
+	existing := map[string]bool{}
+	flagSet.VisitAll(func(f *flag.Flag) { existing[f.Name] = true })
+	if err := d.CreateFlags(flagSet); err != nil {
+		return nil, err
 	}
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if !existing[f.Name] {
+			deprecated[f.Name] = true
+		}
+	})
+	return deprecated, nil
 }
 
 func newFlagSet(errorHandling flag.ErrorHandling) *flag.FlagSet {
 	flagSet := flag.NewFlagSet("server", errorHandling)
 	addr = flagSet.String("addr", ":8080", "http service address")
-	driverPath = flagSet.String("driver", "mdbx", "storage driver")
+	tlsCert = flagSet.String("tls-cert", "", "PEM file of the certificate to serve TLS with, reloaded on SIGHUP")
+	tlsKey = flagSet.String("tls-key", "", "PEM file of the private key of -tls-cert, reloaded on SIGHUP")
+	clientCA = flagSet.String("client-ca", "", "PEM file of the CAs client certificates must be signed by, requiring them when set; reloaded on SIGHUP")
+	allowedOriginsSpec = flagSet.String("allowed-origins", "", "comma separated origins browsers may connect from, * for any; defaults to the host of the server")
+	maxMessageSize = flagSet.Int64("max-message-size", 1<<20, "maximum size in bytes of a message, larger ones close the connection")
+	maxConnectionsPerIP = flagSet.Int("max-connections-per-ip", 64, "maximum open connections from an IP address, 0 for no limit")
+	trustedProxiesSpec = flagSet.String("trusted-proxies", "", "comma separated IPs or CIDRs of load balancers whose X-Forwarded-For header gives the IP address of their clients")
+	maxConnectionsPerIdentity = flagSet.Int("max-connections-per-identity", 16, "maximum open connections of an identity on this replica, 0 for no limit")
+	rateLimitsSpec = flagSet.String("rate-limits", "challenge=1:5,connect=1:5,delete-peer=10:50,ice-candidate=50:200", "comma separated method=rate:burst token buckets limiting the requests per second of a connection, * for the methods not listed")
+	driverName = flagSet.String("driver", "bolt", "deprecated and ignored, along with the flags of the driver: the server no longer stores data")
+	flagSet.String("master-key", "", "deprecated and ignored: the server no longer stores data")
+	brokerName = flagSet.String("broker", "memory", "broker sharing connections between replicas: memory for a single replica, or redis")
+	sweepInterval = flagSet.Duration("sweep-interval", 10*time.Second, "interval at which the peers of connections that vanished from other replicas are forgotten")
+	authTokensPath = flagSet.String("auth-tokens", "", "JSON file of bearer tokens accepted when connecting")
+	authKeysPath = flagSet.String("auth-keys", "", "JSON file of ed25519 public keys accepted when connecting")
+	authCertsPath = flagSet.String("auth-certs", "", "JSON file of client certificate common names accepted when connecting, verified against -client-ca")
+	allowAnonymous = flagSet.Bool("allow-anonymous", false, "accept connections without credentials, for development only")
+	resumeGrace = flagSet.Duration("resume-grace", 30*time.Second, "time a disconnected service may reconnect within to resume its session and keep its peers, 0 to disable; sessions are held by the replica the service was connected to, so behind a load balancer resuming needs sticky sessions, and a service reconnecting to another replica starts a new session")
+	routingPath = flagSet.String("routing", "", "JSON file of rules restricting which users are announced to which services")
+	iceServersPath = flagSet.String("ice-servers", "", "JSON file of STUN and TURN servers handed to peers")
+	stunURLs = flagSet.String("stun", "", "comma separated STUN server urls handed to peers")
+	turnURLs = flagSet.String("turn", "", "comma separated TURN server urls handed to peers, with credentials minted from -turn-secret")
+	turnSecret = flagSet.String("turn-secret", "", "secret shared with the TURN servers for minting TURN REST API credentials")
+	turnTTL = flagSet.Duration("turn-ttl", 24*time.Hour, "lifetime of minted TURN credentials")
+	turnListen = flagSet.String("turn-listen", "", "UDP and TCP address of the embedded TURN server, disabled if empty")
+	turnRelayIP = flagSet.String("turn-relay-ip", "", "public IP address the embedded TURN server relays through")
+	turnHost = flagSet.String("turn-host", "", "host the embedded TURN server is advertised with, defaults to -turn-relay-ip")
 
 	return flagSet
 }
@@ -79,10 +142,35 @@ func NewFlagSet() *flag.FlagSet {
 }
 
 func Run() error {
-	if err := loadStorageDriver(); err != nil {
+	if err := loadBroker(); err != nil {
+		return err
+	} else if err := loadLimits(); err != nil {
+		return err
+	} else if err := loadAuthenticators(); err != nil {
+		return err
+	} else if err := loadRoutingPolicy(); err != nil {
+		return err
+	} else if err := loadICEConfig(); err != nil {
+		return err
+	} else if err := startTURNServer(); err != nil {
+		return err
+	} else if err := startBroker(); err != nil {
+		return err
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
 		return err
 	}
 
 	http.HandleFunc("/", websocketHandler)
-	return http.ListenAndServe(*addr, nil)
+	server := &http.Server{
+		Addr:      *addr,
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	} else {
+		return server.ListenAndServe()
+	}
 }
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	_ "github.com/grexie/vault/storage/bolt"
+)
+
+// TestStorageFlags checks that the storage flags of earlier versions still
+// parse, with those of the driver they name.
+func TestStorageFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"-addr", ":8081"}, true},
+		{[]string{"-driver", "bolt", "-master-key", "master.key"}, true},
+		{[]string{"-datadir", "data"}, true},
+		{[]string{"-driver", "bolt", "-datadir", "data"}, true},
+		{[]string{"-driver", "unknown", "-master-key", "master.key"}, true},
+		{[]string{"-driver", "unknown", "-datadir", "data"}, false},
+		{[]string{"-unknown"}, false},
+	}
+
+	for _, test := range tests {
+		flagSet := NewFlagSet()
+		flagSet.Parse(test.args)
+		driver := *driverName
+
+		flagSet = newFlagSet(flag.ContinueOnError)
+		flagSet.SetOutput(io.Discard)
+		deprecated, err := createStorageFlags(flagSet, driver)
+		if err != nil {
+			t.Fatal(err)
+		} else if !deprecated["driver"] || !deprecated["master-key"] || deprecated["addr"] {
+			t.Errorf("%v: deprecated flags %v", test.args, deprecated)
+		}
+
+		if err := flagSet.Parse(test.args); test.ok && err != nil {
+			t.Errorf("%v: %v", test.args, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%v: parsed", test.args)
+		}
+	}
+}
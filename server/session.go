@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"time"
+)
+
+// sessions holds the services that may be resumed by their resume token:
+// those connected, and those disconnected within the last -resume-grace,
+// which keep their session ID and peers until then. Sessions hold the hub and
+// peers of the replica, so they are not shared through the broker and only
+// resume on the replica that issued the token.
+var sessions = map[string]*protocol{}
+
+func newResumeToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// resume hands the session of token over to p, which takes the session ID
+// and the peers of the previous connection. The previous connection is
+// closed if it is still open. It returns false if there is no such session or it belongs
+// to another identity. The mutex must be held.
+func (p *protocol) resume(token string) bool {
+	previous, ok := sessions[token]
+	if !ok || previous.identity.Name != p.identity.Name || previous.identity.Tenant != p.identity.Tenant || previous.connectRequest.Type != p.connectRequest.Type {
+		return false
+	}
+	delete(sessions, token)
+
+	previous.resumed = true
+	if previous.expiry != nil {
+		previous.expiry.Stop()
+	} else {
+		go previous.conn.Close()
+	}
+
+	previous.Lock()
+	p.Lock()
+	p.id = previous.id
+	p.peers = previous.peers
+	previous.peers = map[string]bool{}
+	p.Unlock()
+	previous.Unlock()
+	return true
+}
+
+// suspend keeps the session of p for -resume-grace after its connection
+// closed, returning false if p cannot be resumed. The mutex must be held.
+func (p *protocol) suspend() bool {
+	if p.resumeToken == "" {
+		return false
+	} else if *resumeGrace <= 0 {
+		delete(sessions, p.resumeToken)
+		return false
+	}
+
+	p.expiry = time.AfterFunc(*resumeGrace, p.expire)
+	return true
+}
+
+func (p *protocol) expire() {
+	mutex.Lock()
+	if p.resumed {
+		mutex.Unlock()
+		return
+	}
+	delete(sessions, p.resumeToken)
+	if err := presenceBroker.Leave(p.presence); err != nil {
+		log.Println(err)
+	}
+	mutex.Unlock()
+
+	log.Println("session expired:", p.connectRequest.Type, p.sessionID())
+	p.end()
+
+	mutex.Lock()
+	delete(protocols, p.sessionID())
+	mutex.Unlock()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	proto "github.com/grexie/vault/protocol"
+)
+
+// TestResume checks that a resumed connection takes over the session ID and
+// peers of the previous one without changing the ID of either hub, which are
+// read while the session is handed over.
+func TestResume(t *testing.T) {
+	previous, _ := newTestProtocol("previous", proto.CONNECT_TYPE_SERVICE)
+	previous.identity = &Identity{Name: "svc"}
+	previous.connectRequest.Type = proto.CONNECT_TYPE_SERVICE
+	previous.peers["peer"] = true
+	previous.expiry = time.AfterFunc(time.Hour, func() {})
+
+	tests := []struct {
+		name     string
+		identity *Identity
+		resumed  bool
+	}{
+		{"another identity", &Identity{Name: "other"}, false},
+		{"the same identity", &Identity{Name: "svc"}, true},
+		{"a resumed session", &Identity{Name: "svc"}, false},
+	}
+
+	mutex.Lock()
+	sessions["token"] = previous
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(sessions, "token")
+		mutex.Unlock()
+	}()
+
+	for _, test := range tests {
+		p, _ := newTestProtocol("next", proto.CONNECT_TYPE_SERVICE)
+		p.id = p.hub.ID
+		p.identity = test.identity
+		p.connectRequest.Type = proto.CONNECT_TYPE_SERVICE
+		hubID := p.hub.ID
+
+		done := make(chan struct{})
+		read := make(chan struct{})
+		go func() {
+			defer close(read)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					if p.sessionID(); p.hub.ID != hubID {
+						t.Errorf("%v: hub ID changed to %v", test.name, p.hub.ID)
+						return
+					}
+				}
+			}
+		}()
+
+		mutex.Lock()
+		resumed := p.resume("token")
+		mutex.Unlock()
+		close(done)
+		<-read
+
+		if resumed != test.resumed {
+			t.Errorf("%v: resumed = %v, want %v", test.name, resumed, test.resumed)
+		} else if !resumed {
+			if p.sessionID() != hubID || len(p.peers) != 0 {
+				t.Errorf("%v: took over session %v with peers %v", test.name, p.sessionID(), p.peers)
+			}
+		} else if p.sessionID() != "previous" || !p.peers["peer"] || len(previous.peers) != 0 {
+			t.Errorf("%v: took over session %v with peers %v, left %v", test.name, p.sessionID(), p.peers, previous.peers)
+		}
+	}
+}
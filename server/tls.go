@@ -0,0 +1,116 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certificates holds the certificate of the server and the CAs client
+// certificates are verified against, reloaded from their files on SIGHUP so
+// that they can be rotated without a restart.
+type certificates struct {
+	sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	if bytes, err := os.ReadFile(filename); err != nil {
+		return nil, err
+	} else if pool := x509.NewCertPool(); !pool.AppendCertsFromPEM(bytes) {
+		return nil, fmt.Errorf("no certificates found in %v", filename)
+	} else {
+		return pool, nil
+	}
+}
+
+func (c *certificates) load() error {
+	certificate, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if *clientCA != "" {
+		if clientCAs, err = loadCertPool(*clientCA); err != nil {
+			return err
+		}
+	}
+
+	c.Lock()
+	c.certificate = &certificate
+	c.clientCAs = clientCAs
+	c.Unlock()
+	return nil
+}
+
+// config returns the TLS configuration of a connection. Clients must present
+// a certificate signed by -client-ca when it is set.
+func (c *certificates) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*c.certificate},
+		// websockets are upgraded from HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+	}
+	if c.clientCAs != nil {
+		config.ClientCAs = c.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func (c *certificates) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.certificate, nil
+}
+
+func (c *certificates) reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := c.load(); err != nil {
+				log.Println("tls: keeping the current certificates, reload failed:", err)
+			} else {
+				log.Println("tls: certificates reloaded")
+			}
+		}
+	}()
+}
+
+// loadTLSConfig returns the TLS configuration of the server, or nil when
+// -tls-cert is not set and the server listens without TLS.
+func loadTLSConfig() (*tls.Config, error) {
+	if *tlsCert == "" && *tlsKey == "" {
+		if *clientCA != "" {
+			return nil, fmt.Errorf("-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	} else if *tlsCert == "" || *tlsKey == "" {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+
+	c := &certificates{}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.reloadOnSIGHUP()
+
+	return &tls.Config{
+		GetCertificate:     c.getCertificate,
+		GetConfigForClient: c.config,
+	}, nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/pion/turn/v2"
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// turnRealm is the realm of the embedded TURN server.
+const turnRealm = "vault"
+
+var turnServer *turn.Server
+
+type turnSession struct {
+	key    []byte
+	server *webrtc.ICEServer
+}
+
+// turnSessions holds the TURN credentials of every connected hub, by
+// username. A hub's credentials stop being accepted when its session ends.
+var turnSessions = map[string]*turnSession{}
+var turnSessionsMutex = sync.Mutex{}
+
+// startTURNServer runs the embedded TURN server on the UDP and TCP port of
+// -turn-listen, if set, relaying through -turn-relay-ip.
+func startTURNServer() error {
+	if *turnListen == "" {
+		return nil
+	}
+
+	relayIP := net.ParseIP(*turnRelayIP)
+	if relayIP == nil {
+		return fmt.Errorf("-turn-listen requires -turn-relay-ip to be the public IP address of the server")
+	}
+
+	udpListener, err := net.ListenPacket("udp4", *turnListen)
+	if err != nil {
+		return err
+	}
+
+	tcpListener, err := net.Listen("tcp4", *turnListen)
+	if err != nil {
+		udpListener.Close()
+		return err
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       turnRealm,
+		AuthHandler: turnAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: relayIP,
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener: tcpListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: relayIP,
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+	})
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		return err
+	}
+
+	turnServer = server
+	log.Println("turn server listening on", *turnListen, "relaying through", relayIP)
+	return nil
+}
+
+func turnAuthHandler(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+	turnSessionsMutex.Lock()
+	defer turnSessionsMutex.Unlock()
+
+	if session, ok := turnSessions[username]; ok {
+		return session.key, true
+	}
+	return nil, false
+}
+
+// embeddedTURNURLs returns the urls the embedded TURN server is advertised with.
+func embeddedTURNURLs() ([]string, error) {
+	_, port, err := net.SplitHostPort(*turnListen)
+	if err != nil {
+		return nil, err
+	}
+
+	host := *turnHost
+	if host == "" {
+		host = *turnRelayIP
+	}
+	address := net.JoinHostPort(host, port)
+
+	return []string{
+		fmt.Sprintf("turn:%v?transport=udp", address),
+		fmt.Sprintf("turn:%v?transport=tcp", address),
+	}, nil
+}
+
+// startTURNSession mints the credentials of p for the embedded TURN server,
+// returning nil if it is not running. A resumed session keeps its
+// credentials, which its relayed peers still use.
+func startTURNSession(p *protocol) *webrtc.ICEServer {
+	if turnServer == nil {
+		return nil
+	}
+
+	turnSessionsMutex.Lock()
+	session, ok := turnSessions[p.sessionID()]
+	turnSessionsMutex.Unlock()
+	if ok {
+		return session.server
+	}
+
+	urls, err := embeddedTURNURLs()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		log.Println(err)
+		return nil
+	}
+	username := p.sessionID()
+	password := base64.RawURLEncoding.EncodeToString(secret)
+
+	server := &webrtc.ICEServer{
+		URLs:       urls,
+		Username:   username,
+		Credential: password,
+	}
+
+	turnSessionsMutex.Lock()
+	turnSessions[username] = &turnSession{
+		key:    turn.GenerateAuthKey(username, turnRealm, password),
+		server: server,
+	}
+	turnSessionsMutex.Unlock()
+
+	return server
+}
+
+func endTURNSession(p *protocol) {
+	turnSessionsMutex.Lock()
+	delete(turnSessions, p.sessionID())
+	turnSessionsMutex.Unlock()
+}
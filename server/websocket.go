@@ -10,7 +10,8 @@ import (
 
 var (
 	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin:  checkOrigin,
+		Subprotocols: hub.Subprotocols(hub.Codecs()),
 	}
 )
 
@@ -23,9 +24,19 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer c.Close()
 
-	h := hub.NewHub(c)
+	ip := remoteIP(r)
+	if !admitIP(ip) {
+		log.Println("rejected:", ip, "too many connections")
+		closeConnection(c, websocket.CloseTryAgainLater, "too many connections")
+		return
+	}
+	defer releaseIP(ip)
+
+	c.SetReadLimit(*maxMessageSize)
+
+	h := hub.NewHubWithCodec(c, hub.SubprotocolCodec(c.Subprotocol()))
 
-	if protocol, err := newProtocol(h); err != nil {
+	if protocol, err := newProtocol(h, c, r); err != nil {
 		log.Println(err)
 		return
 	} else {
@@ -36,9 +47,11 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		_, message, err := c.ReadMessage()
 		if err != nil {
 			log.Println(err)
+			h.Close(err)
 			return
 		} else if err := h.ProcessMessage(message); err != nil {
 			log.Println(err)
+			h.Close(err)
 			return
 		}
 	}
@@ -0,0 +1,151 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8). Each share
+// holds one evaluated polynomial per byte of the secret followed by the x
+// coordinate the polynomials were evaluated at.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+var expTable [255]byte
+var logTable [256]byte
+
+func init() {
+	// Build the exponent and logarithm tables of GF(2^8) with the AES
+	// reduction polynomial x^8 + x^4 + x^3 + x + 1 and generator 3.
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+
+		// x = x * 3 = x * 2 + x
+		doubled := x << 1
+		if x&0x80 != 0 {
+			doubled ^= 0x1b
+		}
+		x ^= doubled
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if b == 0 {
+		panic("shamir: division by zero")
+	} else if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
+
+// evaluate returns the value at x of the polynomial with coefficients, lowest
+// degree first, using Horner's method.
+func evaluate(coefficients []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// Split divides secret into parts shares, any threshold of which are needed
+// to reconstruct it. A threshold of 1 makes every share a copy of the secret,
+// for vaults kept by a single operator.
+func Split(secret []byte, parts int, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	} else if parts < threshold {
+		return nil, errors.New("parts cannot be less than threshold")
+	} else if parts > 255 {
+		return nil, errors.New("parts cannot exceed 255")
+	} else if threshold < 1 {
+		return nil, errors.New("threshold must be at least 1")
+	}
+
+	// Pick distinct non-zero x coordinates in a random order.
+	coordinates := make([]byte, 255)
+	for i := range coordinates {
+		coordinates[i] = byte(i + 1)
+	}
+	random := make([]byte, 255)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	for i := len(coordinates) - 1; i > 0; i-- {
+		j := int(random[i]) % (i + 1)
+		coordinates[i], coordinates[j] = coordinates[j], coordinates[i]
+	}
+
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = coordinates[i]
+	}
+
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for i := range shares {
+			shares[i][j] = evaluate(coefficients, coordinates[i])
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine reconstructs a secret from at least threshold of the shares
+// returned by Split. Combining fewer shares yields an unrelated value rather
+// than an error.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("at least one share is required")
+	}
+
+	length := len(shares[0])
+	if length < 2 {
+		return nil, errors.New("shares are too short")
+	}
+
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if len(share) != length {
+			return nil, errors.New("shares must be the same length")
+		} else if x := share[length-1]; x == 0 || seen[x] {
+			return nil, fmt.Errorf("duplicate or invalid share coordinate %d", x)
+		} else {
+			seen[x] = true
+		}
+	}
+
+	secret := make([]byte, length-1)
+	for j := range secret {
+		// Lagrange interpolation of the polynomial at x = 0.
+		value := byte(0)
+		for i, share := range shares {
+			xi := share[length-1]
+			basis := byte(1)
+			for k, other := range shares {
+				if k == i {
+					continue
+				}
+				xk := other[length-1]
+				basis = mul(basis, div(xk, xk^xi))
+			}
+			value ^= mul(share[j], basis)
+		}
+		secret[j] = value
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,118 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// subsets returns every subset of size k of shares.
+func subsets(shares [][]byte, k int) [][][]byte {
+	if k == 0 {
+		return [][][]byte{{}}
+	} else if len(shares) < k {
+		return nil
+	}
+
+	result := [][][]byte{}
+	for _, subset := range subsets(shares[1:], k-1) {
+		result = append(result, append([][]byte{shares[0]}, subset...))
+	}
+	return append(result, subsets(shares[1:], k)...)
+}
+
+func TestSplitCombine(t *testing.T) {
+	tests := []struct {
+		size      int
+		parts     int
+		threshold int
+	}{
+		{32, 1, 1},
+		{32, 3, 1},
+		{1, 2, 2},
+		{32, 3, 2},
+		{32, 5, 3},
+		{32, 5, 5},
+		{64, 10, 4},
+		{16, 255, 2},
+	}
+
+	for _, test := range tests {
+		secret := make([]byte, test.size)
+		if _, err := rand.Read(secret); err != nil {
+			t.Fatal(err)
+		}
+
+		shares, err := Split(secret, test.parts, test.threshold)
+		if err != nil {
+			t.Fatalf("Split(%v, %v, %v): %v", test.size, test.parts, test.threshold, err)
+		} else if len(shares) != test.parts {
+			t.Fatalf("Split(%v, %v, %v) returned %v shares", test.size, test.parts, test.threshold, len(shares))
+		}
+
+		if test.parts > 10 {
+			shares = shares[:10]
+		}
+		for _, subset := range subsets(shares, test.threshold) {
+			if combined, err := Combine(subset); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(combined, secret) {
+				t.Fatalf("%v of %v shares combined into another secret", test.threshold, test.parts)
+			}
+		}
+
+		// fewer shares than the threshold reveal nothing of the secret
+		if test.threshold > 2 && test.size >= 16 {
+			if combined, err := Combine(shares[:test.threshold-1]); err != nil {
+				t.Fatal(err)
+			} else if bytes.Equal(combined, secret) {
+				t.Fatalf("%v shares below the threshold of %v combined into the secret", test.threshold-1, test.threshold)
+			}
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    []byte
+		parts     int
+		threshold int
+	}{
+		{"empty secret", nil, 3, 2},
+		{"parts below threshold", []byte("secret"), 2, 3},
+		{"too many parts", []byte("secret"), 256, 2},
+		{"threshold of zero", []byte("secret"), 3, 0},
+		{"no parts", []byte("secret"), 0, 0},
+	}
+
+	for _, test := range tests {
+		if _, err := Split(test.secret, test.parts, test.threshold); err == nil {
+			t.Errorf("%v: split", test.name)
+		}
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"no shares", nil},
+		{"duplicate shares", [][]byte{shares[0], shares[0]}},
+		{"different lengths", [][]byte{shares[0], shares[1][1:]}},
+		{"too short", [][]byte{{1}, {2}}},
+		{"zero coordinate", [][]byte{shares[0], append(append([]byte{}, shares[1][:6]...), 0)}},
+	}
+
+	for _, test := range tests {
+		if _, err := Combine(test.shares); err == nil {
+			t.Errorf("%v: combined", test.name)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package bolt
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/grexie/vault/storage"
+	bbolt "go.etcd.io/bbolt"
+)
+
+const pageSize = 100
+
+// BoltDriver stores each domain as a bucket of a single bbolt database file.
+// It is pure Go and therefore available in static and CGO_ENABLED=0 builds.
+type BoltDriver struct {
+	datadir *string
+	db      *bbolt.DB
+}
+
+func init() {
+	storage.Register("bolt", func() storage.Driver {
+		return &BoltDriver{}
+	})
+}
+
+func (d *BoltDriver) CreateFlags(flagSet *flag.FlagSet) error {
+	d.datadir = flagSet.String("datadir", storage.DefaultDataDir(), "the directory in which to store data")
+	return nil
+}
+
+func (d *BoltDriver) Initialize() error {
+	if err := os.MkdirAll(*d.datadir, 0700); err != nil {
+		return err
+	} else if db, err := bbolt.Open(path.Join(*d.datadir, "vault.db"), 0600, &bbolt.Options{Timeout: time.Second}); err != nil {
+		return err
+	} else {
+		d.db = db
+		return nil
+	}
+}
+
+func (d *BoltDriver) List(domain string, cursor storage.Cursor) (*storage.Page, error) {
+	var after string
+	if cursor != nil {
+		if s, ok := cursor.(string); !ok {
+			return nil, fmt.Errorf("invalid cursor %v", cursor)
+		} else {
+			after = s
+		}
+	}
+
+	page := &storage.Page{Items: []storage.Item{}}
+
+	if err := d.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(domain))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+
+		var k, v []byte
+		if cursor == nil {
+			k, v = c.First()
+		} else if k, v = c.Seek([]byte(after)); k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if len(page.Items) == pageSize {
+				page.Next = page.Items[len(page.Items)-1].Key
+				return nil
+			}
+			page.Items = append(page.Items, storage.Item{Key: string(k), Value: string(v)})
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func (d *BoltDriver) Get(domain string, key string) (*storage.Item, error) {
+	var item *storage.Item
+
+	if err := d.db.View(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket([]byte(domain)); bucket == nil {
+			return nil
+		} else if v := bucket.Get([]byte(key)); v == nil {
+			return nil
+		} else {
+			item = &storage.Item{Key: key, Value: string(v)}
+			return nil
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (d *BoltDriver) Set(domain string, key string, value string) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		if bucket, err := tx.CreateBucketIfNotExists([]byte(domain)); err != nil {
+			return err
+		} else {
+			return bucket.Put([]byte(key), []byte(value))
+		}
+	})
+}
+
+func (d *BoltDriver) Remove(domain string, key string) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket([]byte(domain)); bucket == nil {
+			return nil
+		} else {
+			return bucket.Delete([]byte(key))
+		}
+	})
+}
+
+func (d *BoltDriver) Flush(domain string) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(domain)); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,220 @@
+package encrypted
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grexie/vault/storage"
+)
+
+// KeyringDomain is the domain the wrapped data keys are stored in. It is
+// reserved and cannot be written through the encrypted driver.
+const KeyringDomain = "encrypted:keyring"
+
+const keySize = 32
+
+var ErrReservedDomain = errors.New("domain is reserved")
+
+// Driver wraps a storage.Driver so that every value is encrypted with
+// AES-256-GCM before it reaches the underlying driver. Each domain has its own
+// data key, which is itself stored encrypted with the master key. The domain
+// and key of an item are authenticated as associated data, so a value cannot
+// be moved to another entry without failing to decrypt.
+//
+// Flush holds flushMutex exclusively while the other operations hold it
+// shared, so that no value is written under a data key being removed.
+type Driver struct {
+	storage.Driver
+	flushMutex sync.RWMutex
+	mutex      sync.Mutex
+	master     cipher.AEAD
+	dataKeys   map[string]cipher.AEAD
+}
+
+func NewDriver(driver storage.Driver, masterKey []byte) (*Driver, error) {
+	if master, err := newAEAD(masterKey); err != nil {
+		return nil, err
+	} else {
+		return &Driver{
+			Driver:   driver,
+			master:   master,
+			dataKeys: map[string]cipher.AEAD{},
+		}, nil
+	}
+}
+
+// GenerateKey returns a new random key suitable as a master key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid key size %d, expected %d", len(key), keySize)
+	} else if block, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return cipher.NewGCM(block)
+	}
+}
+
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, additionalData)), nil
+}
+
+func open(aead cipher.AEAD, ciphertext string, additionalData []byte) ([]byte, error) {
+	if bytes, err := base64.StdEncoding.DecodeString(ciphertext); err != nil {
+		return nil, err
+	} else if len(bytes) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	} else {
+		return aead.Open(nil, bytes[:aead.NonceSize()], bytes[aead.NonceSize():], additionalData)
+	}
+}
+
+func keyringAdditionalData(domain string) []byte {
+	return []byte(KeyringDomain + "\x00" + domain)
+}
+
+func itemAdditionalData(domain string, key string) []byte {
+	return []byte(domain + "\x00" + key)
+}
+
+// dataKey returns the data key for domain, unwrapping it from the keyring or
+// generating and storing a new one when create is set. It returns nil if the
+// domain has no data key and create is not set.
+func (d *Driver) dataKey(domain string, create bool) (cipher.AEAD, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if aead, ok := d.dataKeys[domain]; ok {
+		return aead, nil
+	}
+
+	var key []byte
+	if item, err := d.Driver.Get(KeyringDomain, domain); err != nil {
+		return nil, err
+	} else if item != nil {
+		if key, err = open(d.master, item.Value, keyringAdditionalData(domain)); err != nil {
+			return nil, fmt.Errorf("unable to unwrap data key for domain %q: %w", domain, err)
+		}
+	} else if !create {
+		return nil, nil
+	} else if key, err = GenerateKey(); err != nil {
+		return nil, err
+	} else if wrapped, err := seal(d.master, key, keyringAdditionalData(domain)); err != nil {
+		return nil, err
+	} else if err := d.Driver.Set(KeyringDomain, domain, wrapped); err != nil {
+		return nil, err
+	}
+
+	if aead, err := newAEAD(key); err != nil {
+		return nil, err
+	} else {
+		d.dataKeys[domain] = aead
+		return aead, nil
+	}
+}
+
+func (d *Driver) List(domain string, cursor storage.Cursor) (*storage.Page, error) {
+	d.flushMutex.RLock()
+	defer d.flushMutex.RUnlock()
+
+	if domain == KeyringDomain {
+		return nil, ErrReservedDomain
+	} else if page, err := d.Driver.List(domain, cursor); err != nil {
+		return nil, err
+	} else if len(page.Items) == 0 {
+		return page, nil
+	} else if aead, err := d.dataKey(domain, false); err != nil {
+		return nil, err
+	} else if aead == nil {
+		return nil, fmt.Errorf("no data key for domain %q", domain)
+	} else {
+		items := make([]storage.Item, 0, len(page.Items))
+		for _, item := range page.Items {
+			if value, err := open(aead, item.Value, itemAdditionalData(domain, item.Key)); err != nil {
+				return nil, fmt.Errorf("unable to decrypt %q in domain %q: %w", item.Key, domain, err)
+			} else {
+				items = append(items, storage.Item{Key: item.Key, Value: string(value)})
+			}
+		}
+		return &storage.Page{Items: items, Next: page.Next}, nil
+	}
+}
+
+func (d *Driver) Get(domain string, key string) (*storage.Item, error) {
+	d.flushMutex.RLock()
+	defer d.flushMutex.RUnlock()
+
+	if domain == KeyringDomain {
+		return nil, ErrReservedDomain
+	} else if item, err := d.Driver.Get(domain, key); err != nil || item == nil {
+		return item, err
+	} else if aead, err := d.dataKey(domain, false); err != nil {
+		return nil, err
+	} else if aead == nil {
+		return nil, fmt.Errorf("no data key for domain %q", domain)
+	} else if value, err := open(aead, item.Value, itemAdditionalData(domain, key)); err != nil {
+		return nil, fmt.Errorf("unable to decrypt %q in domain %q: %w", key, domain, err)
+	} else {
+		return &storage.Item{Key: key, Value: string(value)}, nil
+	}
+}
+
+func (d *Driver) Set(domain string, key string, value string) error {
+	d.flushMutex.RLock()
+	defer d.flushMutex.RUnlock()
+
+	if domain == KeyringDomain {
+		return ErrReservedDomain
+	} else if aead, err := d.dataKey(domain, true); err != nil {
+		return err
+	} else if ciphertext, err := seal(aead, []byte(value), itemAdditionalData(domain, key)); err != nil {
+		return err
+	} else {
+		return d.Driver.Set(domain, key, ciphertext)
+	}
+}
+
+func (d *Driver) Remove(domain string, key string) error {
+	if domain == KeyringDomain {
+		return ErrReservedDomain
+	}
+	return d.Driver.Remove(domain, key)
+}
+
+// Flush removes every item in domain along with its data key, so the domain
+// is encrypted under a fresh data key the next time it is written to.
+func (d *Driver) Flush(domain string) error {
+	if domain == KeyringDomain {
+		return ErrReservedDomain
+	}
+
+	d.flushMutex.Lock()
+	defer d.flushMutex.Unlock()
+
+	if err := d.Driver.Flush(domain); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.dataKeys, domain)
+	return d.Driver.Remove(KeyringDomain, domain)
+}
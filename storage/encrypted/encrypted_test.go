@@ -0,0 +1,158 @@
+package encrypted
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grexie/vault/storage"
+	"github.com/grexie/vault/storage/memory"
+)
+
+func newTestDriver(t *testing.T) (*Driver, storage.Driver, []byte) {
+	t.Helper()
+
+	raw := &memory.MemoryDriver{}
+	if err := raw.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	masterKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver, err := NewDriver(raw, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return driver, raw, masterKey
+}
+
+func TestRoundTrip(t *testing.T) {
+	driver, raw, masterKey := newTestDriver(t)
+
+	values := map[string]string{"a": "alpha", "b": "", "c": "gamma"}
+	for key, value := range values {
+		if err := driver.Set("domain", key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, value := range values {
+		if item, err := raw.Get("domain", key); err != nil {
+			t.Fatal(err)
+		} else if value != "" && item.Value == value {
+			t.Errorf("%v is stored in plaintext", key)
+		}
+
+		if item, err := driver.Get("domain", key); err != nil {
+			t.Fatal(err)
+		} else if item.Value != value {
+			t.Errorf("got %q for %v, want %q", item.Value, key, value)
+		}
+	}
+
+	if page, err := driver.List("domain", nil); err != nil {
+		t.Fatal(err)
+	} else if len(page.Items) != len(values) {
+		t.Errorf("listed %v items, want %v", len(page.Items), len(values))
+	}
+
+	// a driver with the same master key reads the data keys from storage
+	if reopened, err := NewDriver(raw, masterKey); err != nil {
+		t.Fatal(err)
+	} else if item, err := reopened.Get("domain", "a"); err != nil || item.Value != "alpha" {
+		t.Errorf("reopened driver got %v, %v", item, err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	driver, raw, _ := newTestDriver(t)
+
+	if err := driver.Set("domain", "a", "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	item, err := raw.Get("domain", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a value moved to another key no longer authenticates
+	if err := raw.Set("domain", "b", item.Value); err != nil {
+		t.Fatal(err)
+	} else if _, err := driver.Get("domain", "b"); err == nil {
+		t.Error("decrypted a value moved to another key")
+	}
+
+	otherKey, _ := GenerateKey()
+	if other, err := NewDriver(raw, otherKey); err != nil {
+		t.Fatal(err)
+	} else if _, err := other.Get("domain", "a"); err == nil {
+		t.Error("decrypted with another master key")
+	} else if err := VerifyMasterKey(raw, otherKey); err == nil {
+		t.Error("verified another master key")
+	}
+
+	if _, err := driver.Get(KeyringDomain, "domain"); !errors.Is(err, ErrReservedDomain) {
+		t.Errorf("got %v, want the keyring domain to be reserved", err)
+	}
+}
+
+// pausingDriver pauses the first Set until released, so that a test can
+// flush in the middle of it.
+type pausingDriver struct {
+	storage.Driver
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (d *pausingDriver) Set(domain string, key string, value string) error {
+	if domain != KeyringDomain {
+		d.once.Do(func() {
+			close(d.entered)
+			<-d.release
+		})
+	}
+	return d.Driver.Set(domain, key, value)
+}
+
+// TestFlushDuringSet flushes a domain while a value is being written to it,
+// and checks that the value is either flushed or still readable.
+func TestFlushDuringSet(t *testing.T) {
+	_, raw, masterKey := newTestDriver(t)
+	pausing := &pausingDriver{Driver: raw, entered: make(chan struct{}), release: make(chan struct{})}
+	driver, err := NewDriver(pausing, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := make(chan error, 1)
+	go func() {
+		set <- driver.Set("domain", "key", "value")
+	}()
+	<-pausing.entered
+
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- driver.Flush("domain")
+	}()
+	select {
+	case err := <-flushed:
+		t.Fatalf("flush completed during set: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(pausing.release)
+	if err := <-set; err != nil {
+		t.Fatal(err)
+	} else if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+
+	if item, err := driver.Get("domain", "key"); err != nil {
+		t.Fatal(err)
+	} else if item != nil && item.Value != "value" {
+		t.Fatalf("got %q", item.Value)
+	}
+}
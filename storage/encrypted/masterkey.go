@@ -0,0 +1,62 @@
+package encrypted
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/grexie/vault/storage"
+)
+
+// LoadMasterKey reads a base64 encoded master key from filename, generating
+// and writing a new one with owner-only permissions if the file does not
+// exist.
+func LoadMasterKey(filename string) ([]byte, error) {
+	if key, err := ReadMasterKey(filename); errors.Is(err, fs.ErrNotExist) {
+		if key, err := GenerateKey(); err != nil {
+			return nil, err
+		} else if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
+			return nil, err
+		} else if err := os.WriteFile(filename, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		} else {
+			log.Println("generated master key:", filename)
+			return key, nil
+		}
+	} else {
+		return key, err
+	}
+}
+
+// ReadMasterKey reads a base64 encoded master key from filename.
+func ReadMasterKey(filename string) ([]byte, error) {
+	if bytes, err := os.ReadFile(filename); err != nil {
+		return nil, err
+	} else {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(bytes)))
+	}
+}
+
+// VerifyMasterKey checks that masterKey unwraps the data keys stored in
+// driver, as those of a vault encrypted with it would be.
+func VerifyMasterKey(driver storage.Driver, masterKey []byte) error {
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return err
+	}
+
+	page, err := driver.List(KeyringDomain, nil)
+	if err != nil {
+		return err
+	}
+	for _, item := range page.Items {
+		if _, err := open(master, item.Value, keyringAdditionalData(item.Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,55 +2,178 @@ package main
 
 import (
 	"flag"
-	"log"
+	"fmt"
 	"os"
-	"path"
+	"sync"
 
 	"github.com/grexie/vault/storage"
+	"github.com/torquem-ch/mdbx-go/mdbx"
 )
 
+const pageSize = 100
+
 type MdbxDriver struct {
+	sync.Mutex
 	datadir *string
+	env     *mdbx.Env
+	dbis    map[string]mdbx.DBI
 }
 
 func (d *MdbxDriver) CreateFlags(flagSet *flag.FlagSet) error {
-	if datadir, err := os.UserConfigDir(); err != nil {
+	d.datadir = flagSet.String("datadir", storage.DefaultDataDir(), "the directory in which to store data")
+	return nil
+}
+
+func (d *MdbxDriver) Initialize() error {
+	if err := os.MkdirAll(*d.datadir, 0700); err != nil {
+		return err
+	} else if env, err := mdbx.NewEnv(); err != nil {
+		return err
+	} else if err := env.SetOption(mdbx.OptMaxDB, 1024); err != nil {
+		env.Close()
+		return err
+	} else if err := env.Open(*d.datadir, mdbx.Durable, 0600); err != nil {
+		env.Close()
 		return err
 	} else {
-		d.datadir = flagSet.String("datadir", path.Join(datadir, "grexie", "vault"), "the directory in which to store data")
+		d.env = env
+		d.dbis = map[string]mdbx.DBI{}
+		return nil
 	}
-
-	return nil
 }
 
-func (d *MdbxDriver) Initialize() error {
-	log.Println("mdbx:initialize")
-	return nil
+// dbi returns the handle of the named sub-database backing domain, creating
+// it on first use. Handles are cached for the lifetime of the environment.
+func (d *MdbxDriver) dbi(domain string) (mdbx.DBI, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if dbi, ok := d.dbis[domain]; ok {
+		return dbi, nil
+	}
+
+	var dbi mdbx.DBI
+	if err := d.env.Update(func(txn *mdbx.Txn) (err error) {
+		dbi, err = txn.OpenDBISimple(domain, mdbx.Create)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+
+	d.dbis[domain] = dbi
+	return dbi, nil
 }
 
+// List returns up to pageSize items of domain in key order. The cursor is the
+// last key of the previous page, or nil to start from the beginning; Next is
+// nil once the final page has been returned.
 func (d *MdbxDriver) List(domain string, cursor storage.Cursor) (*storage.Page, error) {
-	log.Println("mdbx:list", domain, cursor)
-	return nil, nil
+	var after string
+	if cursor != nil {
+		if s, ok := cursor.(string); !ok {
+			return nil, fmt.Errorf("invalid cursor %v", cursor)
+		} else {
+			after = s
+		}
+	}
+
+	dbi, err := d.dbi(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &storage.Page{Items: []storage.Item{}}
+
+	if err := d.env.View(func(txn *mdbx.Txn) error {
+		c, err := txn.OpenCursor(dbi)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		var k, v []byte
+		if cursor == nil {
+			k, v, err = c.Get(nil, nil, mdbx.First)
+		} else if k, v, err = c.Get([]byte(after), nil, mdbx.SetRange); err == nil && string(k) == after {
+			k, v, err = c.Get(nil, nil, mdbx.Next)
+		}
+
+		for ; err == nil; k, v, err = c.Get(nil, nil, mdbx.Next) {
+			if len(page.Items) == pageSize {
+				page.Next = page.Items[len(page.Items)-1].Key
+				return nil
+			}
+			page.Items = append(page.Items, storage.Item{Key: string(k), Value: string(v)})
+		}
+
+		if mdbx.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return page, nil
 }
 
 func (d *MdbxDriver) Get(domain string, key string) (*storage.Item, error) {
-	log.Println("mdbx:get", domain, key)
-	return nil, nil
+	dbi, err := d.dbi(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var item *storage.Item
+	if err := d.env.View(func(txn *mdbx.Txn) error {
+		if v, err := txn.Get(dbi, []byte(key)); mdbx.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else {
+			item = &storage.Item{Key: key, Value: string(v)}
+			return nil
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return item, nil
 }
 
 func (d *MdbxDriver) Set(domain string, key string, value string) error {
-	log.Println("mdbx:set", domain, key, value)
-	return nil
+	dbi, err := d.dbi(domain)
+	if err != nil {
+		return err
+	}
+
+	return d.env.Update(func(txn *mdbx.Txn) error {
+		return txn.Put(dbi, []byte(key), []byte(value), 0)
+	})
 }
 
 func (d *MdbxDriver) Remove(domain string, key string) error {
-	log.Println("mdbx:remove", domain, key)
-	return nil
+	dbi, err := d.dbi(domain)
+	if err != nil {
+		return err
+	}
+
+	return d.env.Update(func(txn *mdbx.Txn) error {
+		if err := txn.Del(dbi, []byte(key), nil); err != nil && !mdbx.IsNotFound(err) {
+			return err
+		}
+		return nil
+	})
 }
 
 func (d *MdbxDriver) Flush(domain string) error {
-	log.Println("mdbx:flush", domain)
-	return nil
+	dbi, err := d.dbi(domain)
+	if err != nil {
+		return err
+	}
+
+	return d.env.Update(func(txn *mdbx.Txn) error {
+		return txn.Drop(dbi, false)
+	})
 }
 
 var Driver = MdbxDriver{}
@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/grexie/vault/storage"
+)
+
+const pageSize = 100
+
+// MemoryDriver keeps every domain in process memory. Nothing survives a
+// restart, which makes it suitable for development and throwaway instances.
+type MemoryDriver struct {
+	sync.RWMutex
+	domains map[string]map[string]string
+}
+
+func init() {
+	storage.Register("memory", func() storage.Driver {
+		return &MemoryDriver{}
+	})
+}
+
+func (d *MemoryDriver) CreateFlags(flagSet *flag.FlagSet) error {
+	return nil
+}
+
+func (d *MemoryDriver) Initialize() error {
+	d.domains = map[string]map[string]string{}
+	return nil
+}
+
+func (d *MemoryDriver) List(domain string, cursor storage.Cursor) (*storage.Page, error) {
+	var after string
+	if cursor != nil {
+		if s, ok := cursor.(string); !ok {
+			return nil, fmt.Errorf("invalid cursor %v", cursor)
+		} else {
+			after = s
+		}
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	keys := []string{}
+	for key := range d.domains[domain] {
+		if cursor == nil || key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	page := &storage.Page{Items: []storage.Item{}}
+	for _, key := range keys {
+		if len(page.Items) == pageSize {
+			page.Next = page.Items[len(page.Items)-1].Key
+			break
+		}
+		page.Items = append(page.Items, storage.Item{Key: key, Value: d.domains[domain][key]})
+	}
+
+	return page, nil
+}
+
+func (d *MemoryDriver) Get(domain string, key string) (*storage.Item, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if value, ok := d.domains[domain][key]; !ok {
+		return nil, nil
+	} else {
+		return &storage.Item{Key: key, Value: value}, nil
+	}
+}
+
+func (d *MemoryDriver) Set(domain string, key string, value string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	items, ok := d.domains[domain]
+	if !ok {
+		items = map[string]string{}
+		d.domains[domain] = items
+	}
+	items[key] = value
+
+	return nil
+}
+
+func (d *MemoryDriver) Remove(domain string, key string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.domains[domain], key)
+	return nil
+}
+
+func (d *MemoryDriver) Flush(domain string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.domains, domain)
+	return nil
+}
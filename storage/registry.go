@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var drivers = map[string]func() Driver{}
+var driversMutex = sync.Mutex{}
+
+// Register makes a compiled-in driver available to Open under name. It is
+// intended to be called from the init function of the driver's package.
+func Register(name string, factory func() Driver) {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+
+	if _, exists := drivers[name]; exists {
+		panic(fmt.Sprintf("storage driver %q registered twice", name))
+	}
+	drivers[name] = factory
+}
+
+// Drivers returns the sorted names of the registered drivers.
+func Drivers() []string {
+	driversMutex.Lock()
+	defer driversMutex.Unlock()
+
+	names := []string{}
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open returns a new instance of the driver registered as name. Names that
+// look like a path to a shared object are loaded with plugin.Open instead,
+// as are other names with a plugin of that name in the working directory,
+// so that -driver mdbx still loads mdbx.so.
+func Open(name string) (Driver, error) {
+	if isPluginPath(name) {
+		return openPlugin(name)
+	}
+
+	driversMutex.Lock()
+	factory, ok := drivers[name]
+	driversMutex.Unlock()
+
+	if ok {
+		return factory(), nil
+	} else if _, err := os.Stat(fmt.Sprintf("%v.so", name)); err == nil {
+		return openPlugin(name)
+	}
+	return nil, fmt.Errorf("unknown storage driver %q, available drivers: %v, or the path to a plugin such as %v.so", name, strings.Join(Drivers(), ", "), name)
+}
+
+// Load opens the driver named name, adds its flags to flagSet and parses args
+// before initializing it.
+func Load(name string, flagSet *flag.FlagSet, args []string) (Driver, error) {
+	if driver, err := Open(name); err != nil {
+		return nil, err
+	} else if err := driver.CreateFlags(flagSet); err != nil {
+		return nil, err
+	} else if err := flagSet.Parse(args); err != nil {
+		return nil, err
+	} else if err := driver.Initialize(); err != nil {
+		return nil, err
+	} else {
+		return driver, nil
+	}
+}
+
+// DefaultDataDir returns the directory drivers store their data in when no
+// datadir flag is given.
+func DefaultDataDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return path.Join(dir, "grexie", "vault")
+	}
+	return "data"
+}
+
+func isPluginPath(name string) bool {
+	return strings.HasSuffix(name, ".so") || strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/')
+}
+
+func openPlugin(name string) (Driver, error) {
+	if !strings.HasSuffix(name, ".so") {
+		name = fmt.Sprintf("%v.so", name)
+	}
+
+	if _, err := os.Stat(name); err != nil {
+		return nil, err
+	} else if p, err := plugin.Open(name); err != nil {
+		return nil, err
+	} else if d, err := p.Lookup("Driver"); err != nil {
+		return nil, err
+	} else if driver, ok := d.(Driver); !ok {
+		return nil, fmt.Errorf("%v does not implement storage.Driver", name)
+	} else {
+		return driver, nil
+	}
+}
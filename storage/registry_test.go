@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+type testDriver struct {
+	Driver
+}
+
+func TestOpen(t *testing.T) {
+	Register("registry-test", func() Driver {
+		return &testDriver{}
+	})
+
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(dir)
+
+	// not a valid shared object, but found as the plugin of its name
+	if err := os.WriteFile("plugin-test.so", []byte("not a plugin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		unknown bool
+		fail    bool
+	}{
+		{"registry-test", false, false},
+		{"plugin-test", false, true},
+		{"plugin-test.so", false, true},
+		{"./missing.so", false, true},
+		{"missing", true, true},
+	}
+
+	for _, test := range tests {
+		driver, err := Open(test.name)
+		if !test.fail {
+			if err != nil {
+				t.Errorf("Open(%q): %v", test.name, err)
+			} else if _, ok := driver.(*testDriver); !ok {
+				t.Errorf("Open(%q) = %T", test.name, driver)
+			}
+		} else if err == nil {
+			t.Errorf("Open(%q) = %T, want an error", test.name, driver)
+		} else if unknown := strings.Contains(err.Error(), "unknown storage driver"); unknown != test.unknown {
+			t.Errorf("Open(%q): got %v, want unknown = %v", test.name, err, test.unknown)
+		}
+	}
+}
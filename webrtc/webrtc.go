@@ -1,7 +1,7 @@
 package webrtc
 
 import (
-	"encoding/json"
+	"errors"
 	"log"
 	"sync"
 
@@ -10,11 +10,23 @@ import (
 	webrtc "github.com/pion/webrtc/v3"
 )
 
+// maxQueueLength bounds the messages queued until the data channel opens, and
+// maxBufferedAmount the bytes buffered by the open data channel. Writers
+// block beyond either until the channel catches up.
+const maxQueueLength = 64
+const maxBufferedAmount = 1 << 20
+const bufferedAmountLowThreshold = maxBufferedAmount / 4
+
+var errChannelClosed = errors.New("data channel closed")
+
 type PeerConnection struct {
 	sync.Mutex
 	conn           *webrtc.PeerConnection
 	channel        *webrtc.DataChannel
-	queue          [][]byte
+	writable       *sync.Cond
+	open           bool
+	closed         bool
+	queue          []queuedMessage
 	Hub            *hub.Hub
 	signalling     *hub.Hub
 	iceCandidates  []webrtc.ICECandidateInit
@@ -23,18 +35,22 @@ type PeerConnection struct {
 	ID             string
 }
 
+type queuedMessage struct {
+	messageType int
+	data        []byte
+}
+
 type ICECandidate struct {
 	ID           string                  `json:"id"`
 	ICECandidate webrtc.ICECandidateInit `json:"candidate"`
 }
 
-func NewPeerConnection(id string, urls []string, signalling *hub.Hub) (*PeerConnection, error) {
+// NewPeerConnection creates a peer connection with a data channel carrying a
+// hub encoded with codec. The name of the codec is the protocol of the data
+// channel, so the remote end knows how to decode it.
+func NewPeerConnection(id string, iceServers []webrtc.ICEServer, signalling *hub.Hub, codec hub.Codec) (*PeerConnection, error) {
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: urls,
-			},
-		},
+		ICEServers: iceServers,
 	}
 
 	peerConnection, err := webrtc.NewPeerConnection(config)
@@ -50,20 +66,15 @@ func NewPeerConnection(id string, urls []string, signalling *hub.Hub) (*PeerConn
 		Mutex:         sync.Mutex{},
 		conn:          peerConnection,
 		ID:            id,
-		signalling:    signalling,
 		iceCandidates: []webrtc.ICECandidateInit{},
+		onClose:       func() {},
 	}
+	c.writable = sync.NewCond(&c.Mutex)
 
-	hub := hub.NewHub(c)
-	c.Hub = hub
-
-	removeAnswerHandler := signalling.Handle("answer", c.onAnswer)
-	removeICECandidateHandler := signalling.Handle("ice-candidate", c.onCandidate)
+	h := hub.NewHubWithCodec(c, codec)
+	c.Hub = h
 
-	c.onClose = func() {
-		removeAnswerHandler()
-		removeICECandidateHandler()
-	}
+	c.SetSignalling(signalling)
 
 	peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
 		if i == nil {
@@ -73,19 +84,32 @@ func NewPeerConnection(id string, urls []string, signalling *hub.Hub) (*PeerConn
 		c.sendICECandidate(i.ToJSON())
 	})
 
-	if d, err := peerConnection.CreateDataChannel("hub", nil); err != nil {
+	protocol := codec.Name()
+	if d, err := peerConnection.CreateDataChannel("hub", &webrtc.DataChannelInit{Protocol: &protocol}); err != nil {
 		peerConnection.Close()
 		log.Println(err)
 		return nil, err
 	} else {
 		c.channel = d
+		d.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
 
 		d.OnOpen(func() {
-			queue := c.queue
-			c.queue = [][]byte{}
-			for _, bytes := range queue {
-				d.Send(bytes)
+			c.Lock()
+			defer c.Unlock()
+
+			for _, message := range c.queue {
+				c.send(message.messageType, message.data)
 			}
+			c.queue = []queuedMessage{}
+			c.open = true
+			c.writable.Broadcast()
+		})
+
+		d.OnBufferedAmountLow(func() {
+			c.Lock()
+			defer c.Unlock()
+
+			c.writable.Broadcast()
 		})
 
 		d.OnClose(func() {
@@ -93,20 +117,47 @@ func NewPeerConnection(id string, urls []string, signalling *hub.Hub) (*PeerConn
 		})
 
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
-			hub.ProcessMessage(msg.Data)
+			h.ProcessMessage(msg.Data)
 		})
 	}
 
 	return c, nil
 }
 
+// SetSignalling makes the peer connection exchange its answer and ICE
+// candidates over signalling, such as the hub of a connection resumed after
+// the previous one failed.
+func (c *PeerConnection) SetSignalling(signalling *hub.Hub) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.onClose()
+	removeAnswerHandler := hub.HandleTyped(signalling, "answer", c.onAnswer)
+	removeICECandidateHandler := hub.HandleTyped(signalling, "ice-candidate", c.onCandidate)
+
+	c.signalling = signalling
+	c.onClose = func() {
+		removeAnswerHandler()
+		removeICECandidateHandler()
+	}
+}
+
 func (c *PeerConnection) Close() error {
+	c.Lock()
+	c.closed = true
+	c.writable.Broadcast()
+	c.onClose()
+	c.onClose = func() {}
+	c.Unlock()
+
+	c.Hub.Close(nil)
 	return c.conn.Close()
 }
 
 func (c *PeerConnection) sendICECandidate(iceCandidate webrtc.ICECandidateInit) {
 	c.Lock()
 	if c.answerReceived {
+		signalling := c.signalling
 		c.Unlock()
 
 		candidate := &ICECandidate{
@@ -114,7 +165,7 @@ func (c *PeerConnection) sendICECandidate(iceCandidate webrtc.ICECandidateInit)
 			ICECandidate: iceCandidate,
 		}
 
-		c.signalling.RequestWithoutResponse("ice-candidate", candidate)
+		signalling.RequestWithoutResponse("ice-candidate", candidate)
 	} else {
 		c.iceCandidates = append(c.iceCandidates, iceCandidate)
 		c.Unlock()
@@ -135,17 +186,11 @@ func (c *PeerConnection) CreateOffer() (*webrtc.SessionDescription, error) {
 	}
 }
 
-func (c *PeerConnection) onAnswer(res hub.ResponseWriter, req *hub.Request) error {
-	var createPeerResponse proto.CreatePeerResponse
-
-	if bytes, err := json.Marshal(req.Payload); err != nil {
-		return err
-	} else if err := json.Unmarshal(bytes, &createPeerResponse); err != nil {
-		return err
-	} else if createPeerResponse.ID != c.ID {
-		return nil
+func (c *PeerConnection) onAnswer(req *hub.Request, createPeerResponse proto.CreatePeerResponse) (interface{}, error) {
+	if createPeerResponse.ID != c.ID {
+		return nil, nil
 	} else if err := c.conn.SetRemoteDescription(*createPeerResponse.SessionDescription); err != nil {
-		return err
+		return nil, err
 	}
 
 	c.Lock()
@@ -156,32 +201,43 @@ func (c *PeerConnection) onAnswer(res hub.ResponseWriter, req *hub.Request) erro
 	}
 	c.iceCandidates = []webrtc.ICECandidateInit{}
 
-	return nil
+	return nil, nil
 }
 
-func (c *PeerConnection) onCandidate(res hub.ResponseWriter, req *hub.Request) error {
-	var candidate ICECandidate
-
-	if bytes, err := json.Marshal(req.Payload); err != nil {
-		return err
-	} else if err := json.Unmarshal(bytes, &candidate); err != nil {
-		return err
-	} else if candidate.ID != c.ID {
-		return nil
-	} else if err := c.conn.AddICECandidate(candidate.ICECandidate); err != nil {
-		return err
+func (c *PeerConnection) onCandidate(req *hub.Request, candidate ICECandidate) (interface{}, error) {
+	if candidate.ID != c.ID {
+		return nil, nil
+	} else {
+		return nil, c.conn.AddICECandidate(candidate.ICECandidate)
 	}
+}
 
-	return nil
+func (c *PeerConnection) send(messageType int, data []byte) error {
+	if messageType == hub.TextMessage {
+		return c.channel.SendText(string(data))
+	} else {
+		return c.channel.Send(data)
+	}
 }
 
-func (c *PeerConnection) WriteJSON(message interface{}) error {
-	if bytes, err := json.Marshal(message); err != nil {
-		return err
-	} else if c.channel == nil {
-		c.queue = append(c.queue, bytes)
+// WriteMessage sends a message on the data channel, queueing it until the
+// channel opens. It blocks while the queue or the buffer of the channel is
+// full, so that a slow channel slows down its writers rather than buffering
+// without bound.
+func (c *PeerConnection) WriteMessage(messageType int, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for !c.closed && ((!c.open && len(c.queue) >= maxQueueLength) || (c.open && c.channel.BufferedAmount() > maxBufferedAmount)) {
+		c.writable.Wait()
+	}
+
+	if c.closed {
+		return errChannelClosed
+	} else if !c.open {
+		c.queue = append(c.queue, queuedMessage{messageType, data})
 		return nil
 	} else {
-		return c.channel.Send(bytes)
+		return c.send(messageType, data)
 	}
 }